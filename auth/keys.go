@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+)
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+var ErrUnknownKey error = errors.New("auth: unknown key")
+
+// Key is a verification key.
+// Key.Key is a []byte secret for HS256, an *rsa.PublicKey for RS256 and an ed25519.PublicKey for EdDSA.
+type Key struct {
+	Alg string
+	Key any
+}
+
+// KeyProvider returns the candidate keys for a token's kid header,
+// every key when the token has no kid.
+// Implementations must be safe for concurrent use; rotating keys is up to them.
+type KeyProvider interface {
+	Keys(kid string) ([]Key, error)
+}
+
+// MemoryKeys is an in-memory KeyProvider. Keys can be added and removed at any time,
+// so old and new keys can overlap during a rotation.
+type MemoryKeys struct {
+	mu   sync.RWMutex
+	keys map[string]Key
+}
+
+var _ KeyProvider = (*MemoryKeys)(nil)
+
+func NewMemoryKeys() *MemoryKeys {
+	return &MemoryKeys{
+		keys: make(map[string]Key),
+	}
+}
+
+func (m *MemoryKeys) Set(kid string, key Key) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keys[kid] = key
+}
+
+func (m *MemoryKeys) Remove(kid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, kid)
+}
+
+func (m *MemoryKeys) Keys(kid string) ([]Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if kid != "" {
+		key, ok := m.keys[kid]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return []Key{key}, nil
+	}
+
+	keys := make([]Key, 0, len(m.keys))
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
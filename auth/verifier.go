@@ -0,0 +1,178 @@
+// Package auth verifies the JWTs clients present on the Engine.IO handshake.
+// Only the standard library is used.
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoToken          error = errors.New("auth: no token")
+	ErrMalformedToken   error = errors.New("auth: malformed token")
+	ErrUnsupportedAlg   error = errors.New("auth: unsupported algorithm")
+	ErrInvalidSignature error = errors.New("auth: invalid signature")
+	ErrTokenExpired     error = errors.New("auth: token expired")
+	ErrTokenNotYetValid error = errors.New("auth: token not yet valid")
+	ErrInvalidAudience  error = errors.New("auth: invalid audience")
+	ErrInvalidIssuer    error = errors.New("auth: invalid issuer")
+	ErrNoKeyProvider    error = errors.New("auth: verifier has no key provider")
+)
+
+const DefaultQueryParam = "token"
+
+// Verifier checks HS256, RS256 and EdDSA signed JWTs and their exp, nbf, aud and iss claims.
+type Verifier struct {
+	// Keys provides the verification keys. Without it every token is rejected with ErrNoKeyProvider.
+	Keys KeyProvider
+
+	// Audience, if set, must be one of the token's aud values.
+	Audience string
+	// Issuer, if set, must equal the token's iss.
+	Issuer string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+	// QueryParam names the query parameter holding the token, DefaultQueryParam if empty.
+	QueryParam string
+
+	// Now returns the current time, time.Now if nil.
+	Now func() time.Time
+}
+
+// VerifyRequest verifies the token of a handshake request,
+// taken from a "Bearer" Authorization header or else from the query string.
+func (v *Verifier) VerifyRequest(r *http.Request) (Claims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		param := v.QueryParam
+		if param == "" {
+			param = DefaultQueryParam
+		}
+		token = r.URL.Query().Get(param)
+	}
+	if token == "" {
+		return nil, ErrNoToken
+	}
+
+	return v.Verify(token)
+}
+
+// Verify checks token's signature and claims, returning the claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if v.Keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	keys, err := v.Keys.Keys(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(token[:len(parts[0])+1+len(parts[1])])
+	if err := verifySignature(header.Alg, keys, signed, sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims Claims) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	if exp, ok := claims.ExpiresAt(); ok && !now.Before(exp.Add(v.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims.NotBefore(); ok && now.Add(v.Leeway).Before(nbf) {
+		return ErrTokenNotYetValid
+	}
+	if v.Issuer != "" && claims.Issuer() != v.Issuer {
+		return ErrInvalidIssuer
+	}
+	if v.Audience != "" {
+		for _, aud := range claims.Audience() {
+			if aud == v.Audience {
+				return nil
+			}
+		}
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+// verifySignature accepts sig if any key of the header's algorithm produced it.
+// Keys of another algorithm are never tried, so an RS256 public key cannot be used as an HS256 secret.
+func verifySignature(alg string, keys []Key, signed, sig []byte) error {
+	switch alg {
+	case HS256, RS256, EdDSA:
+	default:
+		return ErrUnsupportedAlg
+	}
+
+	for _, key := range keys {
+		if key.Alg != alg {
+			continue
+		}
+
+		var ok bool
+		switch k := key.Key.(type) {
+		case []byte:
+			mac := hmac.New(sha256.New, k)
+			mac.Write(signed)
+			ok = alg == HS256 && hmac.Equal(mac.Sum(nil), sig)
+		case *rsa.PublicKey:
+			sum := sha256.Sum256(signed)
+			ok = alg == RS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+		case ed25519.PublicKey:
+			ok = alg == EdDSA && ed25519.Verify(k, signed, sig)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func decodeSegment(seg string, v any) error {
+	bs, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sign(t *testing.T, alg, kid string, claims map[string]any, key any) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	secret := []byte("s3cret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaPubDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	keys := NewMemoryKeys()
+	keys.Set("hs", Key{Alg: HS256, Key: secret})
+	keys.Set("rs", Key{Alg: RS256, Key: &rsaKey.PublicKey})
+	keys.Set("ed", Key{Alg: EdDSA, Key: edPub})
+
+	v := &Verifier{
+		Keys:     keys,
+		Audience: "game",
+		Issuer:   "login",
+		Leeway:   5 * time.Second,
+		Now:      func() time.Time { return now },
+	}
+	valid := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "p1", "aud": "game", "iss": "login", "exp": now.Add(time.Minute).Unix()}
+		for k, val := range extra {
+			c[k] = val
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"hs256", sign(t, HS256, "hs", valid(nil), secret), nil},
+		{"rs256", sign(t, RS256, "rs", valid(nil), rsaKey), nil},
+		{"eddsa", sign(t, EdDSA, "ed", valid(nil), edKey), nil},
+		{"no kid tries every key", sign(t, EdDSA, "", valid(nil), edKey), nil},
+		{"wrong secret", sign(t, HS256, "hs", valid(nil), []byte("other")), ErrInvalidSignature},
+		{"alg confusion rsa public key as hmac secret", sign(t, HS256, "rs", valid(nil), rsaPubDER), ErrInvalidSignature},
+		{"alg confusion without kid", sign(t, HS256, "", valid(nil), rsaPubDER), ErrInvalidSignature},
+		{"alg none", sign(t, "none", "hs", valid(nil), nil), ErrUnsupportedAlg},
+		{"unknown kid", sign(t, HS256, "gone", valid(nil), secret), ErrUnknownKey},
+		{"expired", sign(t, HS256, "hs", valid(map[string]any{"exp": now.Add(-time.Minute).Unix()}), secret), ErrTokenExpired},
+		{"expired within leeway", sign(t, HS256, "hs", valid(map[string]any{"exp": now.Add(-time.Second).Unix()}), secret), nil},
+		{"not yet valid", sign(t, HS256, "hs", valid(map[string]any{"nbf": now.Add(time.Minute).Unix()}), secret), ErrTokenNotYetValid},
+		{"nbf within leeway", sign(t, HS256, "hs", valid(map[string]any{"nbf": now.Add(time.Second).Unix()}), secret), nil},
+		{"audience list", sign(t, HS256, "hs", valid(map[string]any{"aud": []string{"web", "game"}}), secret), nil},
+		{"wrong audience", sign(t, HS256, "hs", valid(map[string]any{"aud": "web"}), secret), ErrInvalidAudience},
+		{"missing audience", sign(t, HS256, "hs", valid(map[string]any{"aud": nil}), secret), ErrInvalidAudience},
+		{"wrong issuer", sign(t, HS256, "hs", valid(map[string]any{"iss": "evil"}), secret), ErrInvalidIssuer},
+		{"two segments", "a.b", ErrMalformedToken},
+		{"bad base64", "a.b.c!", ErrMalformedToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+			if err == nil && claims.Subject() != "p1" {
+				t.Errorf("Subject = %q", claims.Subject())
+			}
+		})
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	keys := NewMemoryKeys()
+	v := &Verifier{Keys: keys}
+	oldKey, newKey := []byte("old"), []byte("new")
+	claims := map[string]any{"sub": "p1"}
+
+	keys.Set("k1", Key{Alg: HS256, Key: oldKey})
+	oldToken := sign(t, HS256, "k1", claims, oldKey)
+	if _, err := v.Verify(oldToken); err != nil {
+		t.Fatalf("old token before rotation: %v", err)
+	}
+
+	// both keys are accepted while they overlap
+	keys.Set("k2", Key{Alg: HS256, Key: newKey})
+	newToken := sign(t, HS256, "k2", claims, newKey)
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := v.Verify(token); err != nil {
+			t.Fatalf("during rotation: %v", err)
+		}
+	}
+
+	keys.Remove("k1")
+	if _, err := v.Verify(oldToken); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("old token after rotation: %v", err)
+	}
+	if _, err := v.Verify(newToken); err != nil {
+		t.Fatalf("new token after rotation: %v", err)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("s3cret")
+	keys := NewMemoryKeys()
+	keys.Set("hs", Key{Alg: HS256, Key: secret})
+	token := sign(t, HS256, "hs", map[string]any{"sub": "p1"}, secret)
+
+	r := httptest.NewRequest("GET", "/?EIO=4&transport=polling", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if _, err := (&Verifier{Keys: keys}).VerifyRequest(r); err != nil {
+		t.Errorf("Authorization header: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/?EIO=4&transport=polling&auth="+token, nil)
+	if _, err := (&Verifier{Keys: keys, QueryParam: "auth"}).VerifyRequest(r); err != nil {
+		t.Errorf("query parameter: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/?EIO=4&transport=polling", nil)
+	if _, err := (&Verifier{Keys: keys}).VerifyRequest(r); !errors.Is(err, ErrNoToken) {
+		t.Errorf("no token: %v", err)
+	}
+}
+
+func TestVerifyWithoutKeys(t *testing.T) {
+	token := sign(t, HS256, "", map[string]any{}, []byte("x"))
+	if _, err := (&Verifier{}).Verify(token); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("Verify = %v, want %v", err, ErrNoKeyProvider)
+	}
+}
@@ -0,0 +1,27 @@
+package engineigo
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// Binding selects what ties a sid to the client that opened it.
+type Binding uint8
+
+const (
+	// BindClientIP rejects requests whose client IP differs from the handshake's.
+	BindClientIP Binding = 1 << iota
+	// BindUserAgent rejects requests whose User-Agent differs from the handshake's.
+	BindUserAgent
+)
+
+// boundTo reports whether the request r, coming from ip, matches the handshake on every bound attribute.
+func (s *Session) boundTo(b Binding, r *http.Request, ip netip.Addr) bool {
+	if b&BindClientIP != 0 && ip != s.handshake.ClientIP {
+		return false
+	}
+	if b&BindUserAgent != 0 && r.UserAgent() != s.handshake.Header.Get("User-Agent") {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package engineigo
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP resolves the address of the client behind r.
+// The forwarding header set by the proxies is only believed when r comes from a trusted proxy,
+// and is walked from the nearest hop outwards until an untrusted address is found.
+// Other forwarding headers are ignored, the client may have set them itself.
+func (s *Server) clientIP(r *http.Request) netip.Addr {
+	peer := parseAddr(r.RemoteAddr)
+	if s.proxyHeader == "" || !s.trusted(peer) {
+		return peer
+	}
+
+	var hops []string
+	if s.proxyHeader == "Forwarded" {
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		hops = splitList(r.Header.Values(s.proxyHeader))
+	}
+	if ip, ok := s.firstUntrusted(hops); ok {
+		return ip
+	}
+	return peer
+}
+
+func (s *Server) trusted(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstUntrusted walks hops right to left, returning the first address that is not a trusted proxy,
+// or the leftmost one if every hop is trusted.
+func (s *Server) firstUntrusted(hops []string) (netip.Addr, bool) {
+	var ip netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = parseAddr(hops[i])
+		if !ip.IsValid() {
+			return netip.Addr{}, false
+		}
+		if !s.trusted(ip) {
+			return ip, true
+		}
+	}
+	return ip, ip.IsValid()
+}
+
+// parseAddr accepts "ip", "ip:port", "[ipv6]" and "[ipv6]:port".
+func parseAddr(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+func splitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// forwardedFor extracts the for= parameters of RFC 7239 Forwarded headers.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				hops = append(hops, strings.Trim(v, `"`))
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,42 @@
+package engineigo
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name   string
+		header string
+		remote string
+		h      http.Header
+		want   string
+	}{
+		{"no proxy configured", "", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "10.0.0.1"},
+		{"untrusted peer", "X-Forwarded-For", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "192.0.2.1"},
+		{"x-forwarded-for", "X-Forwarded-For", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.9"}}, "203.0.113.9"},
+		{"x-forwarded-for through proxies", "x-forwarded-for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.9, 10.0.0.2"}}, "203.0.113.9"},
+		{"spoofed forwarded ignored", "X-Forwarded-For", "10.0.0.1:1234", http.Header{"Forwarded": {"for=1.2.3.4"}, "X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"spoofed x-real-ip ignored", "X-Forwarded-For", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"1.2.3.4"}}, "10.0.0.1"},
+		{"x-real-ip", "X-Real-IP", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"203.0.113.9"}}, "203.0.113.9"},
+		{"forwarded", "Forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for=6.6.6.6, for="[2001:db8::1]:4711";proto=https`}}, "2001:db8::1"},
+		{"malformed hop", "X-Forwarded-For", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"garbage"}}, "10.0.0.1"},
+		{"all hops trusted", "X-Forwarded-For", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithTrustedProxies(tt.header, proxies...))
+			if tt.header == "" {
+				s = NewServer()
+			}
+			r := &http.Request{RemoteAddr: tt.remote, Header: tt.h}
+			if got := s.clientIP(r).String(); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
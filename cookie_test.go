@@ -0,0 +1,47 @@
+package engineigo
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestCookie(t *testing.T) {
+	s, ts := newTestServer(t, WithCookie(http.Cookie{HttpOnly: true}))
+	go func() {
+		for range s.Accept() {
+		}
+	}()
+
+	resp, err := http.Get(ts.URL + "/?EIO=4&transport=polling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "io" || cookies[0].Path != "/" || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	if _, ok := s.Session(cookies[0].Value); !ok {
+		t.Errorf("cookie %q is not the sid", cookies[0].Value)
+	}
+}
+
+func TestNoCookieOnRefusedHandshake(t *testing.T) {
+	s, ts := newTestServer(t, WithCookie(http.Cookie{}))
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(ts.URL + "/?EIO=4&transport=polling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if cookies := resp.Cookies(); len(cookies) != 0 {
+		t.Errorf("refused handshake set cookies %v", cookies)
+	}
+}
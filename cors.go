@@ -0,0 +1,102 @@
+package engineigo
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures the Access-Control headers of polling responses.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed to connect.
+	// "*" allows any origin, and a single "*" inside an entry, as in "https://*.example.com", matches any run of characters.
+	AllowedOrigins []string
+	// AllowOriginFunc, if set, decides instead of AllowedOrigins.
+	AllowOriginFunc func(origin string) bool
+
+	AllowCredentials bool
+	// AllowedHeaders lists the request headers allowed in preflights.
+	// If empty, the headers a preflight asks for are allowed.
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache a preflight, not sent if zero.
+	MaxAge time.Duration
+}
+
+func (c *CORSOptions) allowOrigin(origin string) bool {
+	if c.AllowOriginFunc != nil {
+		return c.AllowOriginFunc(origin)
+	}
+	for _, pattern := range c.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigin(pattern, origin string) bool {
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return strings.EqualFold(pattern, origin)
+	}
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.EqualFold(origin[:len(prefix)], prefix) &&
+		strings.EqualFold(origin[len(origin)-len(suffix):], suffix)
+}
+
+func (c *CORSOptions) anyOrigin() bool {
+	if c.AllowOriginFunc != nil {
+		return false
+	}
+	for _, pattern := range c.AllowedOrigins {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers for r and reports whether r was a preflight it has answered.
+func (c *CORSOptions) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if origin == "" {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	if c.allowOrigin(origin) {
+		if c.anyOrigin() && !c.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if len(c.AllowedHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+			} else if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			if c.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+			}
+		}
+	}
+
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return preflight
+}
@@ -0,0 +1,60 @@
+package engineigo
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ProtocolError is an Engine.IO connection error.
+// It is answered to the client as {"code":N,"message":"..."}.
+type ProtocolError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// Standard Engine.IO error codes.
+var (
+	ErrUnknownTransport   = &ProtocolError{Code: 0, Message: "Transport unknown"}
+	ErrUnknownSid         = &ProtocolError{Code: 1, Message: "Session ID unknown"}
+	ErrBadHandshakeMethod = &ProtocolError{Code: 2, Message: "Bad handshake method"}
+	ErrBadRequest         = &ProtocolError{Code: 3, Message: "Bad request"}
+	ErrForbidden          = &ProtocolError{Code: 4, Message: "Forbidden"}
+	ErrUnsupportedVersion = &ProtocolError{Code: 5, Message: "Unsupported protocol version"}
+)
+
+// Codes beyond the standard ones.
+var (
+	// ErrServerShuttingDown refuses handshakes once Shutdown has been called, answered with 503.
+	ErrServerShuttingDown = &ProtocolError{Code: 6, Message: "Server shutting down"}
+	// ErrServerError answers a handshake the server failed to set up, with 500.
+	ErrServerError = &ProtocolError{Code: 7, Message: "Server error"}
+)
+
+// status is the HTTP status answering e, decided by its code so hooks may build their own errors.
+func (e *ProtocolError) status() int {
+	switch e.Code {
+	case ErrForbidden.Code:
+		return http.StatusForbidden
+	case ErrServerShuttingDown.Code:
+		return http.StatusServiceUnavailable
+	case ErrServerError.Code:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeError answers r with perr and reports it to the connection error hook.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, perr *ProtocolError) {
+	if fn := s.onConnectionError; fn != nil {
+		fn(r, perr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(perr.status())
+	json.NewEncoder(w).Encode(perr)
+}
@@ -0,0 +1,54 @@
+package engineigo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type failingIDGen struct{}
+
+func (failingIDGen) NextID() (string, error) {
+	return "", errors.New("no entropy")
+}
+
+func TestProtocolErrorResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []ServerOption
+		query  string
+		status int
+		code   int
+	}{
+		{"unknown transport", nil, "EIO=4&transport=carrier-pigeon", http.StatusBadRequest, 0},
+		{"unknown sid", nil, "EIO=4&transport=polling&sid=nope", http.StatusBadRequest, 1},
+		{"unsupported version", nil, "EIO=2&transport=polling", http.StatusBadRequest, 5},
+		{
+			"hook error with a forbidden code",
+			[]ServerOption{WithAllowRequest(func(r *http.Request) error {
+				return &ProtocolError{Code: 4, Message: "banned"}
+			})},
+			"EIO=4&transport=polling", http.StatusForbidden, 4,
+		},
+		{"id generation failure", []ServerOption{WithIDGenerator(failingIDGen{})}, "EIO=4&transport=polling", http.StatusInternalServerError, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, tt.opts...)
+			resp, err := http.Get(ts.URL + "/?" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var perr ProtocolError
+			if err := json.NewDecoder(resp.Body).Decode(&perr); err != nil {
+				t.Fatalf("body is not a ProtocolError: %v", err)
+			}
+			if resp.StatusCode != tt.status || perr.Code != tt.code {
+				t.Errorf("got %d %+v, want %d with code %d", resp.StatusCode, perr, tt.status, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package engineigo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/taogames/engine.igo/message"
+	"go.uber.org/zap"
+)
+
+// Handler receives session events when registered with Server.Handle.
+// The events of one session are delivered in order, one at a time, OnClose being the last.
+type Handler interface {
+	OnOpen(sess *Session)
+	OnMessage(sess *Session, msg message.Message)
+	// OnUpgrade is called once sess has moved to a new transport.
+	OnUpgrade(sess *Session)
+	OnClose(sess *Session, reason CloseReason)
+}
+
+// Handle makes the server deliver session events to h instead of Accept and ReadMessage.
+// It must be called before the server serves any request.
+// Events run on the server's worker pool, see WithHandlerWorkers, and panics in h are recovered.
+func (s *Server) Handle(h Handler) {
+	workers := s.handlerWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	s.dispatcher = newDispatcher(h, workers, s.logger)
+}
+
+// dispatcher runs the handler's events on a fixed pool of workers.
+// A session's mailbox is scheduled on at most one worker at a time, which keeps its events in order.
+type dispatcher struct {
+	handler Handler
+	logger  *zap.SugaredLogger
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   []*mailbox
+	stopped bool
+
+	// pending counts the events posted but not run yet.
+	pending group
+}
+
+type mailbox struct {
+	mu        sync.Mutex
+	events    []func()
+	scheduled bool
+	closed    bool
+}
+
+func newDispatcher(h Handler, workers int, logger *zap.SugaredLogger) *dispatcher {
+	d := &dispatcher{
+		handler: h,
+		logger:  logger,
+	}
+	d.cond = sync.NewCond(&d.mu)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// post queues fn in m, dropping it if m has been closed.
+// last closes m after fn, so nothing runs after it.
+func (d *dispatcher) post(m *mailbox, fn func(), last bool) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = last
+	m.events = append(m.events, fn)
+	d.pending.add()
+	schedule := !m.scheduled
+	m.scheduled = true
+	m.mu.Unlock()
+
+	if schedule {
+		d.mu.Lock()
+		d.ready = append(d.ready, m)
+		d.mu.Unlock()
+		d.cond.Signal()
+	}
+}
+
+func (d *dispatcher) work() {
+	for {
+		d.mu.Lock()
+		for len(d.ready) == 0 && !d.stopped {
+			d.cond.Wait()
+		}
+		if d.stopped {
+			d.mu.Unlock()
+			return
+		}
+		m := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+		d.mu.Unlock()
+
+		d.run(m)
+	}
+}
+
+// run runs the events of m until it is empty.
+func (d *dispatcher) run(m *mailbox) {
+	for {
+		m.mu.Lock()
+		if len(m.events) == 0 {
+			m.scheduled = false
+			m.mu.Unlock()
+			return
+		}
+		fn := m.events[0]
+		m.events[0] = nil
+		m.events = m.events[1:]
+		m.mu.Unlock()
+
+		d.call(fn)
+		d.pending.done()
+	}
+}
+
+func (d *dispatcher) call(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.logger.Errorf("handler panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	fn()
+}
+
+func (d *dispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+func (s *Session) dispatchOpen() {
+	h := s.server.dispatcher.handler
+	s.server.dispatcher.post(s.mailbox, func() { h.OnOpen(s) }, false)
+}
+
+// dispatchMessage hands the handler the message receive has just queued.
+func (s *Session) dispatchMessage() {
+	h := s.server.dispatcher.handler
+	s.server.dispatcher.post(s.mailbox, func() {
+		select {
+		case msg := <-s.recvCh:
+			h.OnMessage(s, *msg)
+		default:
+		}
+	}, false)
+}
+
+func (s *Session) dispatchUpgrade() {
+	h := s.server.dispatcher.handler
+	s.server.dispatcher.post(s.mailbox, func() { h.OnUpgrade(s) }, false)
+}
+
+func (s *Session) dispatchClose(reason CloseReason) {
+	h := s.server.dispatcher.handler
+	s.server.dispatcher.post(s.mailbox, func() { h.OnClose(s, reason) }, true)
+}
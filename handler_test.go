@@ -0,0 +1,191 @@
+package engineigo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/taogames/engine.igo/message"
+)
+
+// recorder records the events of every session, and signals each OnClose on closed.
+type recorder struct {
+	mu     sync.Mutex
+	events map[string][]string
+	closed chan string
+
+	onMessage func(msg message.Message)
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		events: make(map[string][]string),
+		closed: make(chan string, 16),
+	}
+}
+
+func (h *recorder) record(sess *Session, event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events[sess.ID()] = append(h.events[sess.ID()], event)
+}
+
+func (h *recorder) eventsOf(sid string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.events[sid]...)
+}
+
+func (h *recorder) OnOpen(sess *Session) {
+	h.record(sess, "open")
+}
+
+func (h *recorder) OnMessage(sess *Session, msg message.Message) {
+	if h.onMessage != nil {
+		h.onMessage(msg)
+	}
+	h.record(sess, string(msg.Data))
+}
+
+func (h *recorder) OnUpgrade(sess *Session) {
+	h.record(sess, "upgrade")
+}
+
+func (h *recorder) OnClose(sess *Session, reason CloseReason) {
+	h.record(sess, "close: "+string(reason))
+	h.closed <- sess.ID()
+}
+
+// dialHandled opens a websocket session and returns it with its sid.
+func dialHandled(t *testing.T, url string) (*gorilla.Conn, string) {
+	t.Helper()
+	c, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	_, open, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf HandshakeConfig
+	if err := json.Unmarshal(open[1:], &conf); err != nil {
+		t.Fatalf("bad open packet %q", open)
+	}
+	return c, conf.Sid
+}
+
+func TestHandlerOrder(t *testing.T) {
+	const (
+		sessions = 4
+		messages = 50
+	)
+	h := newRecorder()
+	s, ts := newTestServer(t, WithHandlerWorkers(2))
+	s.Handle(h)
+
+	var wg sync.WaitGroup
+	sids := make([]string, sessions)
+	for i := range sids {
+		c, sid := dialHandled(t, ts.URL)
+		sids[i] = sid
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				c.WriteMessage(gorilla.TextMessage, []byte(fmt.Sprintf("4m%d", j)))
+			}
+			c.WriteMessage(gorilla.TextMessage, []byte("1"))
+		}()
+	}
+	wg.Wait()
+	for range sids {
+		<-h.closed
+	}
+
+	want := []string{"open"}
+	for j := 0; j < messages; j++ {
+		want = append(want, fmt.Sprintf("m%d", j))
+	}
+	want = append(want, "close: "+string(ReasonTransportClose))
+	for _, sid := range sids {
+		if got := h.eventsOf(sid); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("session %s events = %v, want %v", sid, got, want)
+		}
+	}
+}
+
+func TestHandlerNothingAfterClose(t *testing.T) {
+	h := newRecorder()
+	s, ts := newTestServer(t)
+	s.Handle(h)
+
+	_, sid := dialHandled(t, ts.URL)
+	sess, _ := s.Session(sid)
+	sess.Close()
+	sess.Close()
+	<-h.closed
+	sess.dispatchMessage()
+	sess.dispatchUpgrade()
+
+	// anything posted after OnClose would have run by now
+	time.Sleep(50 * time.Millisecond)
+	want := []string{"open", "close: " + string(ReasonForcedClose)}
+	if got := h.eventsOf(sid); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	h := newRecorder()
+	h.onMessage = func(msg message.Message) {
+		if string(msg.Data) == "boom" {
+			panic("boom")
+		}
+	}
+	s, ts := newTestServer(t, WithHandlerWorkers(1))
+	s.Handle(h)
+
+	c, sid := dialHandled(t, ts.URL)
+	for _, data := range []string{"4boom", "4after", "1"} {
+		c.WriteMessage(gorilla.TextMessage, []byte(data))
+	}
+	<-h.closed
+
+	// the panicking event is lost, the session's next ones still run on the only worker
+	want := []string{"open", "after", "close: " + string(ReasonTransportClose)}
+	if got := h.eventsOf(sid); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestShutdownWaitsForHandler(t *testing.T) {
+	h := newRecorder()
+	started := make(chan struct{})
+	h.onMessage = func(message.Message) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+	}
+	s, ts := newTestServer(t)
+	s.Handle(h)
+
+	c, sid := dialHandled(t, ts.URL)
+	c.WriteMessage(gorilla.TextMessage, []byte("4slow"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	want := []string{"open", "slow", "close: " + string(ReasonServerShutdown)}
+	if got := h.eventsOf(sid); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events when Shutdown returned = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package engineigo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/taogames/engine.igo/auth"
+)
+
+// Handshake is a snapshot of the request that opened a session.
+// It does not change when the session upgrades its transport.
+type Handshake struct {
+	Header     http.Header
+	Query      url.Values
+	Host       string
+	RemoteAddr string
+	// ClientIP is the client's address, resolved through trusted proxies.
+	ClientIP netip.Addr
+	// TLS is nil for plain connections, TLS.PeerCertificates holds the client certificate with mTLS.
+	TLS  *tls.ConnectionState
+	Time time.Time
+}
+
+func newHandshake(r *http.Request, ip netip.Addr) *Handshake {
+	hs := &Handshake{
+		Header:     r.Header.Clone(),
+		Query:      r.URL.Query(),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   ip,
+		Time:       time.Now(),
+	}
+	hs.TLS = cloneTLS(r.TLS)
+	return hs
+}
+
+func (hs *Handshake) clone() Handshake {
+	c := *hs
+	c.Header = hs.Header.Clone()
+	c.Query = make(url.Values, len(hs.Query))
+	for k, v := range hs.Query {
+		c.Query[k] = append([]string(nil), v...)
+	}
+	c.TLS = cloneTLS(hs.TLS)
+	return c
+}
+
+// cloneTLS copies state and its slices, so that nobody shares them.
+// The certificates themselves are immutable and stay shared.
+func cloneTLS(state *tls.ConnectionState) *tls.ConnectionState {
+	if state == nil {
+		return nil
+	}
+	c := *state
+	c.PeerCertificates = append([]*x509.Certificate(nil), state.PeerCertificates...)
+	if state.VerifiedChains != nil {
+		c.VerifiedChains = make([][]*x509.Certificate, len(state.VerifiedChains))
+		for i, chain := range state.VerifiedChains {
+			c.VerifiedChains[i] = append([]*x509.Certificate(nil), chain...)
+		}
+	}
+	if state.SignedCertificateTimestamps != nil {
+		c.SignedCertificateTimestamps = make([][]byte, len(state.SignedCertificateTimestamps))
+		for i, sct := range state.SignedCertificateTimestamps {
+			c.SignedCertificateTimestamps[i] = append([]byte(nil), sct...)
+		}
+	}
+	c.OCSPResponse = append([]byte(nil), state.OCSPResponse...)
+	c.TLSUnique = append([]byte(nil), state.TLSUnique...)
+	return &c
+}
+
+type handshakeKey struct{}
+
+// handshakeState carries what the handshake hooks learn about a request to its session.
+type handshakeState struct {
+	identity any
+	claims   auth.Claims
+}
+
+func stateOf(r *http.Request) *handshakeState {
+	st, _ := r.Context().Value(handshakeKey{}).(*handshakeState)
+	return st
+}
+
+// SetIdentity attaches v to the session created by r's handshake.
+// It is meant to be called from the WithAllowRequest hook; elsewhere it does nothing.
+func SetIdentity(r *http.Request, v any) {
+	if st := stateOf(r); st != nil {
+		st.identity = v
+	}
+}
+
+// ClaimsOf returns the claims verified on r's handshake, for use in the WithAllowRequest hook.
+func ClaimsOf(r *http.Request) auth.Claims {
+	if st := stateOf(r); st != nil {
+		return st.claims
+	}
+	return nil
+}
+
+// authorize runs the token verifier and the WithAllowRequest hook on a handshake request.
+// It returns the request to carry on with and, on rejection, the error to answer.
+func (s *Server) authorize(r *http.Request) (*http.Request, *ProtocolError) {
+	st := &handshakeState{}
+	r = r.WithContext(context.WithValue(r.Context(), handshakeKey{}, st))
+
+	if s.verifier != nil {
+		claims, err := s.verifier.VerifyRequest(r)
+		if err != nil {
+			s.logger.Errorf("handshake token rejected: %s", err.Error())
+			return r, ErrForbidden
+		}
+		st.claims = claims
+	}
+
+	if s.allowRequestFn != nil {
+		if err := s.allowRequestFn(r); err != nil {
+			s.logger.Errorf("handshake rejected: %s", err.Error())
+
+			var perr *ProtocolError
+			if errors.As(err, &perr) {
+				return r, perr
+			}
+			return r, ErrForbidden
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,43 @@
+package engineigo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestHandshakeSnapshotIsolated(t *testing.T) {
+	leaf, root := &x509.Certificate{}, &x509.Certificate{}
+	r := httptest.NewRequest("GET", "/?EIO=4&transport=polling&v=1", nil)
+	r.Header.Set("X-Version", "1")
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, root}},
+	}
+
+	hs := newHandshake(r, netip.Addr{})
+	r.Header.Set("X-Version", "2")
+	r.TLS.PeerCertificates[0] = nil
+	r.TLS.VerifiedChains[0][1] = nil
+
+	c := hs.clone()
+	c.Header.Set("X-Version", "3")
+	c.Query.Set("v", "3")
+	c.TLS.PeerCertificates[0] = nil
+	c.TLS.VerifiedChains[0][0] = nil
+
+	if got := hs.Header.Get("X-Version"); got != "1" {
+		t.Errorf("Header = %q", got)
+	}
+	if got := hs.Query.Get("v"); got != "1" {
+		t.Errorf("Query = %q", got)
+	}
+	if hs.TLS.PeerCertificates[0] != leaf {
+		t.Error("PeerCertificates shared")
+	}
+	if hs.TLS.VerifiedChains[0][0] != leaf || hs.TLS.VerifiedChains[0][1] != root {
+		t.Error("VerifiedChains shared")
+	}
+}
@@ -1,6 +1,11 @@
 package message
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidPacket error = errors.New("invalid packet")
 
 type MessageType int
 
@@ -38,7 +43,7 @@ func (pt PacketType) Bytes() []byte {
 func ParsePacketType(b byte) (PacketType, error) {
 	pt := PacketType(b - '0')
 	if pt < PTOpen || pt > PTNoop {
-		return 0, fmt.Errorf("packet type invalid: %c", b)
+		return 0, fmt.Errorf("%w: packet type %c", ErrInvalidPacket, b)
 	}
 	return pt, nil
 }
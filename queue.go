@@ -0,0 +1,292 @@
+package engineigo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
+	"github.com/taogames/engine.igo/transport/polling"
+)
+
+var (
+	ErrQueueFull     error = errors.New("write queue full")
+	ErrSessionClosed error = errors.New("session closed")
+)
+
+// QueueFullPolicy decides what happens when one of the session's queues is full.
+type QueueFullPolicy int
+
+const (
+	// QueueBlock waits until there is room in the queue.
+	QueueBlock QueueFullPolicy = iota
+	// QueueDrop discards the message. WriteMessage returns ErrQueueFull.
+	QueueDrop
+	// QueueClose closes the session with ReasonQueueFull. WriteMessage returns ErrQueueFull.
+	QueueClose
+)
+
+type packet struct {
+	mt   message.MessageType
+	pt   message.PacketType
+	data []byte
+
+	// done, if set, is closed once the packet is flushed.
+	done chan struct{}
+	// state moves from packetQueued to packetTaken when the write loop takes the packet,
+	// or to packetCancelled if its writer gives up first.
+	state atomic.Int32
+}
+
+const (
+	packetQueued int32 = iota
+	packetTaken
+	packetCancelled
+)
+
+func (p *packet) take() bool {
+	return p.state.CompareAndSwap(packetQueued, packetTaken)
+}
+
+// cancel withdraws p, unless the write loop has already taken it.
+func (p *packet) cancel() bool {
+	return p.state.CompareAndSwap(packetQueued, packetCancelled)
+}
+
+// send queues p, waiting for room regardless of the policy.
+func (s *Session) send(p *packet) error {
+	return s.sendContext(context.Background(), p)
+}
+
+// sendContext is send giving up when ctx is done.
+func (s *Session) sendContext(ctx context.Context, p *packet) error {
+	select {
+	case <-s.closeCh:
+		return ErrSessionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.sendCh <- p:
+		return nil
+	}
+}
+
+// trySend queues p, applying the server's write QueueFullPolicy when the queue is full.
+// QueueBlock gives up when ctx is done.
+func (s *Session) trySend(ctx context.Context, p *packet) error {
+	select {
+	case <-s.closeCh:
+		return ErrSessionClosed
+	case s.sendCh <- p:
+		return nil
+	default:
+	}
+
+	switch s.server.writeQueueFullPolicy {
+	case QueueDrop:
+		return ErrQueueFull
+	case QueueClose:
+		s.close(ReasonQueueFull, ErrQueueFull)
+		return ErrQueueFull
+	default:
+		return s.sendContext(ctx, p)
+	}
+}
+
+// flight is a batch of packets flushed to a conn and not yet handed to the peer.
+type flight struct {
+	packets []*packet
+	d       transport.Delivery
+}
+
+// writeLoop drains the write queue into the current conn without waiting for the peer,
+// so on polling every packet queued before a GET arrives goes out with it.
+// A packet's done is closed once its delivery completes.
+// Packets failed by an upgrade are written again, in order, to the conn the session ends up on.
+func (s *Session) writeLoop() {
+	var inflight []flight
+	for {
+		var delivered <-chan struct{}
+		if len(inflight) > 0 {
+			delivered = inflight[0].d.Done()
+		}
+
+		select {
+		case <-s.closeCh:
+			return
+		case <-delivered:
+			f := inflight[0]
+			inflight = inflight[1:]
+			if err := f.d.Err(); errors.Is(err, polling.ErrUpgrade) {
+				// nothing after f was delivered either
+				s.logger.Debug("writeLoop delivery ErrUpgrade")
+				batch := f.packets
+				for _, f := range inflight {
+					batch = append(batch, f.packets...)
+				}
+				f, err := s.flush(batch)
+				if err != nil {
+					s.logger.Debug("writeLoop flush error: ", err)
+					s.close(ReasonTransportError, err)
+					return
+				}
+				inflight = append(inflight[:0], f)
+				continue
+			} else if err != nil {
+				s.logger.Debug("writeLoop delivery error: ", err)
+				s.close(ReasonTransportError, err)
+				return
+			}
+			for _, p := range f.packets {
+				if p.done != nil {
+					close(p.done)
+				}
+			}
+		case p := <-s.sendCh:
+			batch := make([]*packet, 0, 1+len(s.sendCh))
+			if p.take() {
+				batch = append(batch, p)
+			}
+		drain:
+			for {
+				select {
+				case p := <-s.sendCh:
+					if p.take() {
+						batch = append(batch, p)
+					}
+				default:
+					break drain
+				}
+			}
+			if len(batch) == 0 {
+				continue
+			}
+
+			f, err := s.flush(batch)
+			if err != nil {
+				s.logger.Debug("writeLoop flush error: ", err)
+				s.close(ReasonTransportError, err)
+				return
+			}
+			inflight = append(inflight, f)
+		}
+	}
+}
+
+// flush writes batch to the current conn, moving to the new one if an upgrade interrupts it.
+func (s *Session) flush(batch []*packet) (flight, error) {
+	for {
+		s.upgradeLock.Lock()
+		conn := s.conn
+		s.upgradeLock.Unlock()
+
+		d, err := writePackets(conn, batch)
+		if errors.Is(err, polling.ErrUpgrade) {
+			s.logger.Debug("flush ErrUpgrade")
+			continue
+		}
+		return flight{packets: batch, d: d}, err
+	}
+}
+
+func writePackets(conn transport.Conn, batch []*packet) (transport.Delivery, error) {
+	for _, p := range batch {
+		w, err := conn.NextWriter(p.mt, p.pt)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(p.data); err != nil {
+			w.Close()
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Flush(), nil
+}
+
+// receive queues msg for ReadMessage, applying the server's read QueueFullPolicy when the queue is full.
+// With a Handler, every queued message is then dispatched to OnMessage.
+func (s *Session) receive(msg *message.Message) {
+	if s.enqueue(msg) && s.mailbox != nil {
+		s.dispatchMessage()
+	}
+}
+
+func (s *Session) enqueue(msg *message.Message) bool {
+	select {
+	case s.recvCh <- msg:
+		return true
+	default:
+	}
+
+	switch s.server.readQueueFullPolicy {
+	case QueueDrop:
+		s.logger.Debug("read queue full, message dropped")
+	case QueueClose:
+		s.close(ReasonQueueFull, ErrQueueFull)
+	default:
+		select {
+		case <-s.closeCh:
+		case s.recvCh <- msg:
+			return true
+		}
+	}
+	return false
+}
+
+// readLoop reads every packet from the current conn, answering control packets
+// itself so heartbeats keep working while the application is busy.
+func (s *Session) readLoop() {
+	for {
+		mt, pt, rc, err := s.nextReader()
+		if err != nil {
+			s.logger.Debug("readLoop NextReader error: ", err)
+			s.close(reasonOf(err), err)
+			return
+		}
+
+		switch pt {
+		case message.PTPong:
+			rc.Close()
+			select {
+			case s.pongCh <- struct{}{}:
+			default:
+			}
+		case message.PTPing:
+			// v3 clients drive the heartbeat, answer with the same data
+			bs, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				s.logger.Debug("readLoop ReadAll error: ", err)
+				s.close(reasonOf(err), err)
+				return
+			}
+			if s.proto == transport.Protocol3 {
+				go s.send(&packet{mt: message.MTText, pt: message.PTPong, data: bs})
+				select {
+				case s.pongCh <- struct{}{}:
+				default:
+				}
+			}
+		case message.PTClose:
+			rc.Close()
+			s.clientClose.Store(true)
+			s.close(ReasonTransportClose, nil)
+			return
+		case message.PTMessage:
+			bs, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				s.logger.Debug("readLoop ReadAll error: ", err)
+				s.close(reasonOf(err), err)
+				return
+			}
+			s.receive(&message.Message{Type: mt, Data: bs})
+		default:
+			rc.Close()
+		}
+	}
+}
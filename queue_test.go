@@ -0,0 +1,59 @@
+package engineigo
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/taogames/engine.igo/message"
+)
+
+func TestQueueCloseReason(t *testing.T) {
+	var reasons = make(chan CloseReason, 1)
+	s, ts := newTestServer(t,
+		WithWriteQueueSize(1),
+		WithWriteQueueFullPolicy(QueueClose),
+		WithOnClose(func(_ *Session, reason CloseReason, _ error) { reasons <- reason }),
+	)
+	// nobody polls, so the queue fills up
+	sess, _ := handshake(t, s, ts)
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = sess.WriteMessage(&message.Message{Type: message.MTText, Data: []byte("x")})
+	}
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("WriteMessage = %v, want %v", err, ErrQueueFull)
+	}
+	if reason := <-reasons; reason != ReasonQueueFull {
+		t.Errorf("OnClose reason = %q, want %q", reason, ReasonQueueFull)
+	}
+	if !errors.Is(sess.CloseError(), ErrQueueFull) {
+		t.Errorf("CloseError = %v", sess.CloseError())
+	}
+}
+
+func TestPollCarriesEveryQueuedPacket(t *testing.T) {
+	s, ts := newTestServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	// written one by one, while the first one waits for a GET
+	for _, data := range []string{"a", "b", "c"} {
+		if err := sess.WriteMessage(&message.Message{Type: message.MTText, Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	resp, err := http.Get(ts.URL + "/?EIO=4&transport=polling&sid=" + sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "4a\x1e4b\x1e4c"; string(body) != want {
+		t.Fatalf("GET = %q, want %q", body, want)
+	}
+}
@@ -0,0 +1,46 @@
+package engineigo
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
+)
+
+// CloseReason tells why a session ended.
+type CloseReason string
+
+const (
+	// ReasonTransportClose: the client closed the session or its transport.
+	ReasonTransportClose CloseReason = "transport close"
+	// ReasonPingTimeout: the client missed a heartbeat.
+	ReasonPingTimeout CloseReason = "ping timeout"
+	// ReasonParseError: the client sent a malformed packet.
+	ReasonParseError CloseReason = "parse error"
+	// ReasonForcedClose: the application closed the session.
+	ReasonForcedClose CloseReason = "forced close"
+	// ReasonTransportError: the transport failed, e.g. the network dropped.
+	ReasonTransportError CloseReason = "transport error"
+	// ReasonServerShutdown: the server is shutting down.
+	ReasonServerShutdown CloseReason = "server shutting down"
+	// ReasonPayloadTooLarge: the client exceeded maxPayload.
+	ReasonPayloadTooLarge CloseReason = "payload too large"
+	// ReasonQueueFull: a session queue overflowed under the QueueClose policy.
+	ReasonQueueFull CloseReason = "queue full"
+)
+
+// reasonOf classifies a transport error.
+func reasonOf(err error) CloseReason {
+	var corrupt base64.CorruptInputError
+	switch {
+	case errors.Is(err, transport.ErrPayloadTooLarge):
+		return ReasonPayloadTooLarge
+	case errors.Is(err, message.ErrInvalidPacket), errors.As(err, &corrupt):
+		return ReasonParseError
+	case errors.Is(err, transport.ErrPeerClosed):
+		return ReasonTransportClose
+	default:
+		return ReasonTransportError
+	}
+}
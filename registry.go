@@ -0,0 +1,81 @@
+package engineigo
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const registryShards = 32
+
+// registry is a concurrency-safe session map, sharded by sid to keep lock contention low.
+type registry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	sync.RWMutex
+	m map[string]*Session
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].m = make(map[string]*Session)
+	}
+	return r
+}
+
+func (r *registry) shard(id string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+func (r *registry) get(id string) (*Session, bool) {
+	shard := r.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	sess, ok := shard.m[id]
+	return sess, ok
+}
+
+func (r *registry) set(sess *Session) {
+	shard := r.shard(sess.id)
+	shard.Lock()
+	defer shard.Unlock()
+
+	shard.m[sess.id] = sess
+}
+
+func (r *registry) delete(id string) {
+	shard := r.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+
+	delete(shard.m, id)
+}
+
+func (r *registry) count() int {
+	n := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.RLock()
+		n += len(shard.m)
+		shard.RUnlock()
+	}
+	return n
+}
+
+func (r *registry) snapshot() []*Session {
+	sessions := make([]*Session, 0, r.count())
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.RLock()
+		for _, sess := range shard.m {
+			sessions = append(sessions, sess)
+		}
+		shard.RUnlock()
+	}
+	return sessions
+}
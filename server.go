@@ -1,10 +1,16 @@
 package engineigo
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net/http"
+	"net/netip"
+	"sync"
 	"time"
 
+	gorilla "github.com/gorilla/websocket"
+	"github.com/taogames/engine.igo/auth"
+	"github.com/taogames/engine.igo/message"
 	"github.com/taogames/engine.igo/transport"
 	"github.com/taogames/engine.igo/transport/polling"
 	"github.com/taogames/engine.igo/transport/websocket"
@@ -13,17 +19,53 @@ import (
 )
 
 const (
-	EIO = "4"
+	EIO  = "4"
+	EIO3 = "3"
 )
 
+var ErrSessionNotFound error = errors.New("session not found")
+
 type Server struct {
 	pingInterval time.Duration
 	pingTimeout  time.Duration
 	maxPayload   int64
+	allowEIO3    bool
 	transports   *transport.Manager
 
-	sessCh  chan *Session
-	sessMap map[string]*Session
+	transportList []transport.Transport
+	upgrades      map[string][]string
+
+	upgradeTimeout  time.Duration
+	onUpgradeFailed func(sess *Session, err error)
+
+	onConnectionError func(r *http.Request, err *ProtocolError)
+	onClose           func(sess *Session, reason CloseReason, err error)
+
+	allowRequestFn func(r *http.Request) error
+	verifier       *auth.Verifier
+	trustedProxies []netip.Prefix
+	proxyHeader    string
+	binding        Binding
+	cors           *CORSOptions
+	cookie         *http.Cookie
+
+	writeQueueSize       int
+	writeQueueFullPolicy QueueFullPolicy
+	readQueueSize        int
+	readQueueFullPolicy  QueueFullPolicy
+
+	sessCh   chan *Session
+	sessions *registry
+
+	handlerWorkers int
+	dispatcher     *dispatcher
+
+	shutdownLock sync.RWMutex
+	shuttingDown bool
+	// loops runs the sessions' goroutines, accepting those waiting on the Accept channel.
+	loops      group
+	accepting  group
+	acceptOnce sync.Once
 
 	idGen  idgen.Generator
 	logger *zap.SugaredLogger
@@ -49,6 +91,176 @@ func WithMaxPayload(payload int64) ServerOption {
 	}
 }
 
+// WithAllowEIO3 lets protocol v3 (socket.io 2.x) clients connect alongside v4 ones.
+func WithAllowEIO3(allow bool) ServerOption {
+	return func(s *Server) {
+		s.allowEIO3 = allow
+	}
+}
+
+// WithTransports sets the transports the server accepts, polling and websocket otherwise.
+// Unless WithUpgrades is given, each transport may upgrade to every transport after it.
+func WithTransports(ts ...transport.Transport) ServerOption {
+	return func(s *Server) {
+		s.transportList = ts
+	}
+}
+
+// WithPolling makes the server use t instead of polling.Default, without touching the shared default.
+func WithPolling(t *polling.Transport) ServerOption {
+	return func(s *Server) {
+		s.replaceTransport(t)
+	}
+}
+
+// WithWebsocket makes the server use t instead of websocket.Default, without touching the shared default.
+// NewServer panics if t is invalid, see websocket.Transport.Validate.
+func WithWebsocket(t *websocket.Transport) ServerOption {
+	return func(s *Server) {
+		s.replaceTransport(t)
+	}
+}
+
+// WithUpgrades sets the upgrade graph, mapping a transport name to the names it may upgrade to.
+// A nil or empty graph disables upgrades. NewServer panics if the graph is invalid.
+func WithUpgrades(graph map[string][]string) ServerOption {
+	return func(s *Server) {
+		if graph == nil {
+			graph = map[string][]string{}
+		}
+		s.upgrades = graph
+	}
+}
+
+// WithUpgradeTimeout bounds how long a transport upgrade may take before it is rolled back.
+func WithUpgradeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.upgradeTimeout = timeout
+	}
+}
+
+// WithOnUpgradeFailed sets a callback run when a session's upgrade fails and it stays on its old transport.
+func WithOnUpgradeFailed(fn func(sess *Session, err error)) ServerOption {
+	return func(s *Server) {
+		s.onUpgradeFailed = fn
+	}
+}
+
+// WithOnConnectionError sets a callback run for every request rejected with a ProtocolError.
+func WithOnConnectionError(fn func(r *http.Request, err *ProtocolError)) ServerOption {
+	return func(s *Server) {
+		s.onConnectionError = fn
+	}
+}
+
+// WithOnClose sets a callback run once when a session ends.
+// It runs on the goroutine that closed the session.
+func WithOnClose(fn func(sess *Session, reason CloseReason, err error)) ServerOption {
+	return func(s *Server) {
+		s.onClose = fn
+	}
+}
+
+// WithAllowRequest sets a hook run on every handshake before a session is created.
+// Returning an error rejects the handshake with ErrForbidden, or with the error itself if it is a *ProtocolError.
+// The hook may call SetIdentity to attach an identity to the session.
+func WithAllowRequest(fn func(r *http.Request) error) ServerOption {
+	return func(s *Server) {
+		s.allowRequestFn = fn
+	}
+}
+
+// WithVerifier makes every handshake present a token accepted by v, rejecting it with ErrForbidden otherwise.
+// The verified claims are available from Session.Claims, and from ClaimsOf in the WithAllowRequest hook.
+// It panics if v has no Keys.
+func WithVerifier(v *auth.Verifier) ServerOption {
+	if v != nil && v.Keys == nil {
+		panic("engineigo: WithVerifier needs a Verifier with Keys")
+	}
+	return func(s *Server) {
+		s.verifier = v
+	}
+}
+
+// WithTrustedProxies resolves a client's address from header when the request comes from one of prefixes.
+// header is the one forwarding header the proxies set, such as "X-Forwarded-For", "X-Real-IP" or "Forwarded" (RFC 7239);
+// the others are ignored. Without it the client address is the request's RemoteAddr.
+func WithTrustedProxies(header string, prefixes ...netip.Prefix) ServerOption {
+	return func(s *Server) {
+		s.proxyHeader = http.CanonicalHeaderKey(header)
+		s.trustedProxies = prefixes
+	}
+}
+
+// WithSessionBinding rejects requests for a sid with ErrForbidden unless they match its handshake on b.
+// The session itself is left open, so a guessed sid cannot be used to end it either.
+func WithSessionBinding(b Binding) ServerOption {
+	return func(s *Server) {
+		s.binding = b
+	}
+}
+
+// WithCORS answers cross-origin preflights and sets Access-Control headers on polling responses.
+func WithCORS(opts CORSOptions) ServerOption {
+	return func(s *Server) {
+		s.cors = &opts
+	}
+}
+
+// WithCookie sets a cookie carrying the sid on every handshake response, for load balancer affinity.
+// Its Value is replaced by the sid, and its Name and Path default to "io" and "/".
+func WithCookie(cookie http.Cookie) ServerOption {
+	return func(s *Server) {
+		if cookie.Name == "" {
+			cookie.Name = "io"
+		}
+		if cookie.Path == "" {
+			cookie.Path = "/"
+		}
+		s.cookie = &cookie
+	}
+}
+
+// WithIDGenerator sets the generator of session ids, idgen.Default otherwise.
+func WithIDGenerator(g idgen.Generator) ServerOption {
+	return func(s *Server) {
+		s.idGen = g
+	}
+}
+
+// WithWriteQueueSize sets how many outbound packets each session buffers.
+func WithWriteQueueSize(size int) ServerOption {
+	return func(s *Server) {
+		s.writeQueueSize = size
+	}
+}
+
+func WithWriteQueueFullPolicy(policy QueueFullPolicy) ServerOption {
+	return func(s *Server) {
+		s.writeQueueFullPolicy = policy
+	}
+}
+
+// WithReadQueueSize sets how many inbound messages each session buffers for ReadMessage.
+func WithReadQueueSize(size int) ServerOption {
+	return func(s *Server) {
+		s.readQueueSize = size
+	}
+}
+
+func WithReadQueueFullPolicy(policy QueueFullPolicy) ServerOption {
+	return func(s *Server) {
+		s.readQueueFullPolicy = policy
+	}
+}
+
+// WithHandlerWorkers sets how many goroutines run Handler events, GOMAXPROCS by default.
+func WithHandlerWorkers(n int) ServerOption {
+	return func(s *Server) {
+		s.handlerWorkers = n
+	}
+}
+
 func WithLogger(logger *zap.SugaredLogger) ServerOption {
 	return func(s *Server) {
 		s.logger = logger
@@ -57,21 +269,45 @@ func WithLogger(logger *zap.SugaredLogger) ServerOption {
 
 func NewServer(opts ...ServerOption) *Server {
 	srv := &Server{
-		pingInterval: 25 * time.Second,
-		pingTimeout:  20 * time.Second,
-		transports: transport.NewManager([]transport.Transport{
+		pingInterval:   25 * time.Second,
+		pingTimeout:    20 * time.Second,
+		maxPayload:     1e6,
+		upgradeTimeout: 10 * time.Second,
+		transportList: []transport.Transport{
 			polling.Default,
 			websocket.Default,
-		}),
-		sessMap: make(map[string]*Session),
-		sessCh:  make(chan *Session),
-		idGen:   idgen.Default,
+		},
+		writeQueueSize:       256,
+		writeQueueFullPolicy: QueueBlock,
+		readQueueSize:        256,
+		readQueueFullPolicy:  QueueBlock,
+		sessions:             newRegistry(),
+		sessCh:               make(chan *Session),
+		idGen:                idgen.Default,
 	}
 
 	for _, o := range opts {
 		o(srv)
 	}
 
+	for _, t := range srv.transportList {
+		if t, ok := t.(*websocket.Transport); ok {
+			if err := t.Validate(); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	if srv.upgrades == nil {
+		srv.transports = transport.NewManager(srv.transportList)
+	} else {
+		transports, err := transport.NewGraphManager(srv.transportList, srv.upgrades)
+		if err != nil {
+			panic(err)
+		}
+		srv.transports = transports
+	}
+
 	if srv.logger == nil {
 		logger, err := zap.NewProduction()
 		if err != nil {
@@ -83,23 +319,43 @@ func NewServer(opts ...ServerOption) *Server {
 	return srv
 }
 
+// replaceTransport swaps the registered transport named like t for t, or registers t if there is none.
+func (s *Server) replaceTransport(t transport.Transport) {
+	ts := make([]transport.Transport, 0, len(s.transportList)+1)
+	replaced := false
+	for _, v := range s.transportList {
+		if v.Name() == t.Name() {
+			v, replaced = t, true
+		}
+		ts = append(ts, v)
+	}
+	if !replaced {
+		ts = append(ts, t)
+	}
+	s.transportList = ts
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// websocket handshakes are not subject to CORS
+	if s.cors != nil && !gorilla.IsWebSocketUpgrade(r) && s.cors.handle(w, r) {
+		return
+	}
+
 	query := r.URL.Query()
-	s.logger.Debugf("%-8s%s", r.Method, query.Encode())
+	ip := s.clientIP(r)
+	s.logger.Debugf("%-8s%-16s%s", r.Method, ip, query.Encode())
 
-	if reqEIO := query.Get("EIO"); reqEIO != EIO {
-		errMsg := fmt.Sprintf("invalid EIO=%s", reqEIO)
-		s.logger.Error(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	if reqEIO := query.Get("EIO"); reqEIO != EIO && !(s.allowEIO3 && reqEIO == EIO3) {
+		s.logger.Errorf("invalid EIO=%s", reqEIO)
+		s.writeError(w, r, ErrUnsupportedVersion)
 		return
 	}
 
 	reqTransportName := query.Get("transport")
 	reqTransport, ok := s.transports.Get(reqTransportName)
 	if !ok {
-		errMsg := fmt.Sprintf("invalid transport=%s", reqTransportName)
-		s.logger.Error(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		s.logger.Errorf("invalid transport=%s", reqTransportName)
+		s.writeError(w, r, ErrUnknownTransport)
 		return
 	}
 
@@ -109,53 +365,64 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 	if sid == "" {
 		if r.Method != http.MethodGet {
-			errMsg := fmt.Sprintf("invalid handshake method=%s", r.Method)
-			s.logger.Error(errMsg)
-			http.Error(w, errMsg, http.StatusBadRequest)
+			s.logger.Errorf("invalid handshake method=%s", r.Method)
+			s.writeError(w, r, ErrBadHandshakeMethod)
 			return
 		}
-		// 新连接
-		conn, err := reqTransport.Accept(w, r)
-		if err != nil {
-			s.logger.Errorf("tranport %s accept: %s", reqTransportName, err.Error())
-			http.Error(w, "server error", http.StatusInternalServerError)
+		if s.isShuttingDown() {
+			s.writeError(w, r, ErrServerShuttingDown)
 			return
 		}
-		sess, err = s.newSession(conn)
+
+		var perr *ProtocolError
+		if r, perr = s.authorize(r); perr != nil {
+			s.writeError(w, r, perr)
+			return
+		}
+
+		sid, err := s.idGen.NextID()
 		if err != nil {
-			s.logger.Errorf("new session: %s", err.Error())
-			http.Error(w, "server error", http.StatusInternalServerError)
+			s.logger.Errorf("new session id: %s", err.Error())
+			s.writeError(w, r, ErrServerError)
+			return
+		}
+		if sess = s.accept(w, r, reqTransport, sid, ip); sess == nil {
 			return
 		}
 	} else {
 		var ok bool
-		sess, ok = s.sessMap[sid]
+		sess, ok = s.sessions.get(sid)
 		if !ok {
-			errMsg := fmt.Sprintf("session=%v not exist", sid)
-			s.logger.Error(errMsg)
-			http.Error(w, errMsg, http.StatusBadRequest)
+			s.logger.Errorf("session=%v not exist", sid)
+			s.writeError(w, r, ErrUnknownSid)
+			return
+		}
+		if !sess.boundTo(s.binding, r, ip) {
+			s.logger.Errorf("session=%v request from %s does not match its handshake", sid, ip)
+			s.writeError(w, r, ErrForbidden)
 			return
 		}
 
 		// Upgrade
 		if reqTransportName != sess.Transport() {
 			if !s.transports.CanUpgrade(sess.Transport(), reqTransportName) {
-				errMsg := fmt.Sprintf("session=%s cannot upgrade from %s to %s", sid, sess.Transport(), reqTransportName)
-				s.logger.Error(errMsg)
-				http.Error(w, errMsg, http.StatusBadRequest)
+				s.logger.Errorf("session=%s cannot upgrade from %s to %s", sid, sess.Transport(), reqTransportName)
+				s.writeError(w, r, ErrBadRequest)
 				return
 			}
 			if err := sess.Upgrade(w, r, reqTransport); err != nil {
 				s.logger.Errorf("session=%s upgrade: %s", sid, err.Error())
-				http.Error(w, "server error", http.StatusInternalServerError)
+				if errors.Is(err, ErrUpgrading) {
+					s.writeError(w, r, ErrBadRequest)
+				}
+				// otherwise the new transport has already answered the request
 				return
 			}
 		} else if !sess.Unique(r.Method) {
 			// Duplicate
-			errMsg := fmt.Sprintf("session=%v duplicate method=%v", sid, r.Method)
-			s.logger.Error(errMsg)
-			http.Error(w, errMsg, http.StatusBadRequest)
-			s.closeSession(sess)
+			s.logger.Errorf("session=%v duplicate method=%v", sid, r.Method)
+			s.writeError(w, r, ErrBadRequest)
+			s.closeSession(sess, ReasonTransportError, errors.New("duplicate "+r.Method))
 			return
 		} else {
 			defer sess.UnlockMethod(r.Method)
@@ -164,7 +431,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if err := sess.ServeHTTP(w, r); err != nil {
 		s.logger.Errorf("session=%s ServeHTTP: %s", sess.id, err.Error())
-		s.closeSession(sess)
+		s.closeSession(sess, reasonOf(err), err)
 	}
 }
 
@@ -180,17 +447,49 @@ type HandshakeConfig struct {
 	MaxPayload   int64    `json:"maxPayload"`
 }
 
-func (s *Server) newSession(conn transport.Conn) (*Session, error) {
-	sid, err := s.idGen.NextID()
+func (s *Server) isShuttingDown() bool {
+	s.shutdownLock.RLock()
+	defer s.shutdownLock.RUnlock()
+
+	return s.shuttingDown
+}
+
+// accept opens a session for the handshake r over t, or answers r and returns nil if it cannot.
+func (s *Server) accept(w http.ResponseWriter, r *http.Request, t transport.Transport, sid string, ip netip.Addr) *Session {
+	// held until the session is registered, so Shutdown sees every session
+	s.shutdownLock.RLock()
+	defer s.shutdownLock.RUnlock()
+	if s.shuttingDown {
+		s.writeError(w, r, ErrServerShuttingDown)
+		return nil
+	}
+
+	// before Accept, which answers websocket handshakes right away
+	if s.cookie != nil {
+		cookie := *s.cookie
+		cookie.Value = sid
+		http.SetCookie(w, &cookie)
+	}
+
+	// 新连接
+	conn, err := t.Accept(w, r)
 	if err != nil {
-		return nil, err
+		// the transport has already answered the request
+		s.logger.Errorf("tranport %s accept: %s", t.Name(), err.Error())
+		return nil
 	}
+	return s.newSession(sid, conn, r, ip)
+}
 
+func (s *Server) newSession(sid string, conn transport.Conn, r *http.Request, ip netip.Addr) *Session {
 	sess := &Session{
-		id:     sid,
-		server: s,
-		conn:   conn,
-		logger: s.logger.With("sid", sid),
+		id:        sid,
+		server:    s,
+		conn:      conn,
+		proto:     transport.ProtocolOf(r),
+		handshake: newHandshake(r, ip),
+		state:     stateOf(r),
+		logger:    s.logger.With("sid", sid, "ip", ip),
 		conf: &HandshakeConfig{
 			Sid:          sid,
 			PingInterval: s.pingInterval.Milliseconds(),
@@ -198,27 +497,73 @@ func (s *Server) newSession(conn transport.Conn) (*Session, error) {
 			Upgrades:     s.transports.Upgradable(conn.Name()),
 			MaxPayload:   s.maxPayload,
 		},
-		pongCh:  make(chan struct{}),
-		closeCh: make(chan struct{}),
+		pongCh:      make(chan struct{}, 1),
+		closeCh:     make(chan struct{}),
+		heartbeatCh: make(chan struct{}),
+		sendCh:      make(chan *packet, s.writeQueueSize),
+		recvCh:      make(chan *message.Message, s.readQueueSize),
 	}
+	sess.ctx, sess.cancel = context.WithCancel(context.Background())
+	conn.SetReadLimit(s.maxPayload)
 
-	go func() {
-		sess.Init()
+	if s.dispatcher != nil {
+		sess.mailbox = &mailbox{}
+	}
+	// registered before any loop that can close it, or close would remove it first
+	s.sessions.set(sess)
 
-		s.sessMap[sid] = sess
-		s.sessCh <- sess
+	s.loops.Go(sess.writeLoop)
+	if s.dispatcher != nil {
+		// the open packet goes out before anything OnOpen writes
+		sess.Init()
+		sess.dispatchOpen()
+	} else {
+		s.accepting.Go(func() {
+			sess.Init()
 
-		go sess.Ping()
-	}()
+			select {
+			case s.sessCh <- sess:
+			case <-sess.closeCh:
+			}
+		})
+	}
+	s.loops.Go(sess.readLoop)
+	sess.startHeartbeat()
 
-	return sess, nil
+	return sess
 }
 
-func (s *Server) closeSession(sess *Session) {
-	delete(s.sessMap, sess.id)
-	sess.Close()
+func (s *Server) closeSession(sess *Session, reason CloseReason, err error) {
+	s.sessions.delete(sess.id)
+	sess.close(reason, err)
 }
 
 func (s *Server) removeSession(sess *Session) {
-	delete(s.sessMap, sess.id)
+	s.sessions.delete(sess.id)
+}
+
+// Session returns the open session with the given id.
+func (s *Server) Session(id string) (*Session, bool) {
+	return s.sessions.get(id)
+}
+
+// Sessions returns a snapshot of the open sessions.
+func (s *Server) Sessions() []*Session {
+	return s.sessions.snapshot()
+}
+
+// Count returns the number of open sessions.
+func (s *Server) Count() int {
+	return s.sessions.count()
+}
+
+// CloseSession closes the session with the given id, recording reason and err, which may be nil, as the cause.
+// Admin tools can use ReasonForcedClose or a CloseReason of their own.
+func (s *Server) CloseSession(id string, reason CloseReason, err error) error {
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s.closeSession(sess, reason, err)
+	return nil
 }
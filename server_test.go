@@ -0,0 +1,67 @@
+package engineigo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/taogames/engine.igo/transport/websocket"
+)
+
+func TestSessionRemovedWhenPeerDropsAtOnce(t *testing.T) {
+	s, ts := newTestServer(t)
+	go func() {
+		for range s.Accept() {
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		c, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?EIO=4&transport=websocket", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dead sessions still registered", s.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseSessionReason(t *testing.T) {
+	const kicked CloseReason = "kicked by admin"
+	cause := errors.New("cheating")
+	s, ts := newTestServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	if err := s.CloseSession(sid, kicked, cause); err != nil {
+		t.Fatal(err)
+	}
+	if reason := sess.CloseReason(); reason != kicked {
+		t.Errorf("CloseReason = %q, want %q", reason, kicked)
+	}
+	if err := sess.CloseError(); err != cause {
+		t.Errorf("CloseError = %v, want %v", err, cause)
+	}
+	if _, ok := s.Session(sid); ok {
+		t.Error("closed session still registered")
+	}
+	if err := s.CloseSession(sid, kicked, nil); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("CloseSession of a closed session = %v, want %v", err, ErrSessionNotFound)
+	}
+}
+
+func TestNewServerRejectsCompressionLevel(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewServer accepted an invalid compression level")
+		}
+	}()
+	NewServer(WithWebsocket(&websocket.Transport{EnableCompression: true, CompressionLevel: 42}))
+}
@@ -1,13 +1,16 @@
 package engineigo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/taogames/engine.igo/auth"
 	"github.com/taogames/engine.igo/message"
 	"github.com/taogames/engine.igo/transport"
 	"github.com/taogames/engine.igo/transport/polling"
@@ -15,13 +18,20 @@ import (
 )
 
 var (
-	ErrTransportError error = errors.New("transport error")
+	ErrTransportError  error = errors.New("transport error")
+	ErrPayloadTooLarge error = transport.ErrPayloadTooLarge
+	ErrUpgrading       error = errors.New("upgrade already in progress")
+	ErrUpgradeTimeout  error = errors.New("upgrade timed out")
 )
 
 type Session struct {
 	id     string
 	server *Server
 	conn   transport.Conn
+	proto  int
+
+	handshake *Handshake
+	state     *handshakeState
 
 	conf *HandshakeConfig
 
@@ -30,77 +40,117 @@ type Session struct {
 	getLock  sync.Mutex
 	postLock sync.Mutex
 
-	closeCh chan struct{}
-	pongCh  chan struct{}
+	closeCh     chan struct{}
+	heartbeatCh chan struct{}
+	// pongCh signals a heartbeat from the client: a PONG in v4, a PING in v3.
+	pongCh chan struct{}
+
+	sendCh chan *packet
+	recvCh chan *message.Message
+	// mailbox holds the session's Handler events, nil without Server.Handle.
+	mailbox *mailbox
 
+	// upgradeLock is held while an upgrade has paused the old conn, so writes wait for the new one.
+	// connLock only guards conn.
 	upgradeLock sync.Mutex
-	clientClose bool
+	connLock    sync.Mutex
+	upgrading   atomic.Bool
+	// clientClose is set once a CLOSE packet has been exchanged, so closing the conn does not send another.
+	clientClose atomic.Bool
+
+	closeLock   sync.Mutex
+	closeReason CloseReason
+	closeErr    error
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (s *Session) ID() string {
 	return s.id
 }
 
-func (s *Session) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
-	return s.conn.ServeHTTP(w, r)
+// Context returns a context cancelled when the session closes.
+func (s *Session) Context() context.Context {
+	return s.ctx
 }
 
-func (s *Session) Init() {
-	w, err := s.conn.NextWriter(message.MTText, message.PTOpen)
-	defer func() {
-		if err := w.Close(); err != nil {
-			s.logger.Error("Init Close error: ", err)
-		}
-	}()
-	if err != nil {
-		s.logger.Error("Init NextWriter error: ", err)
-		return
+// Identity returns what the WithAllowRequest hook attached with SetIdentity, or nil.
+func (s *Session) Identity() any {
+	return s.state.identity
+}
+
+// Claims returns the token claims verified on the handshake, or nil without WithVerifier.
+func (s *Session) Claims() auth.Claims {
+	return s.state.claims
+}
+
+// Handshake returns a copy of the handshake request snapshot.
+func (s *Session) Handshake() Handshake {
+	return s.handshake.clone()
+}
+
+// ServeHTTP serves r on the session's conn.
+// Errors of a conn the session has since upgraded away from are not reported.
+func (s *Session) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	conn := s.currentConn()
+	if err := conn.ServeHTTP(w, r); err != nil && s.currentConn() == conn {
+		return err
 	}
+	return nil
+}
+
+// currentConn returns the conn without waiting for an upgrade in progress.
+func (s *Session) currentConn() transport.Conn {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
 
+	return s.conn
+}
+
+func (s *Session) Init() {
 	s.conf.Sid = s.id
 	j, _ := json.Marshal(s.conf)
 
-	_, err = w.Write(j)
-	if err != nil {
-		s.logger.Errorf("Init Write %v error", string(j))
+	if err := s.send(&packet{mt: message.MTText, pt: message.PTOpen, data: j}); err != nil {
+		s.logger.Errorf("Init Write %v error: %v", string(j), err)
+		return
 	}
 	s.logger.Debug("Init Write ", string(j))
 }
 
-func (s *Session) nextWriter(mt message.MessageType, pt message.PacketType) (io.WriteCloser, error) {
-	for {
-		s.upgradeLock.Lock()
-		conn := s.conn
-		s.upgradeLock.Unlock()
-
-		w, err := conn.NextWriter(mt, pt)
-		if err != nil {
-			if errors.Is(err, polling.ErrUpgrade) {
-				s.logger.Debug("NextWriter ErrUpgrade")
-				continue
-			}
-			return nil, errors.Join(err, ErrTransportError)
-		}
-		return w, nil
-	}
+// WriteMessage queues msg and returns without waiting for it to be delivered.
+// msg.Data must not be modified after the call.
+// When the queue is full, the server's QueueFullPolicy decides what happens.
+func (s *Session) WriteMessage(msg *message.Message) error {
+	return s.trySend(context.Background(), &packet{mt: msg.Type, pt: message.PTMessage, data: msg.Data})
 }
 
-func (s *Session) WriteMessage(msg *message.Message) error {
-	w, err := s.nextWriter(msg.Type, message.PTMessage)
-	if err != nil {
+// WriteMessageContext queues msg like WriteMessage, then waits until it has been written to the transport:
+// sent on websocket, handed to a GET on polling.
+// If ctx is done before the write loop takes msg, msg is withdrawn and never sent.
+// If it is done later, msg is still sent whole, and only the wait is abandoned.
+// Either way ctx's error is returned.
+func (s *Session) WriteMessageContext(ctx context.Context, msg *message.Message) error {
+	p := &packet{mt: msg.Type, pt: message.PTMessage, data: msg.Data, done: make(chan struct{})}
+	if err := s.trySend(ctx, p); err != nil {
 		return err
 	}
-	if _, err := w.Write(msg.Data); err != nil {
-		return err
+
+	select {
+	case <-p.done:
+		return nil
+	case <-s.closeCh:
+		return ErrSessionClosed
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
 	}
-	return w.Close()
 }
 
 func (s *Session) nextReader() (message.MessageType, message.PacketType, io.ReadCloser, error) {
 	for {
-		s.upgradeLock.Lock()
-		conn := s.conn
-		s.upgradeLock.Unlock()
+		conn := s.currentConn()
 
 		mt, pt, rc, err := conn.NextReader()
 		if err != nil {
@@ -108,124 +158,255 @@ func (s *Session) nextReader() (message.MessageType, message.PacketType, io.Read
 				s.logger.Debug("NextReader ErrUpgrade")
 				continue
 			}
-			return 0, 0, nil, errors.Join(err, ErrTransportError)
-		}
-
-		switch pt {
-		case message.PTPong:
-			s.pongCh <- struct{}{}
-			rc.Close()
-			continue
-		case message.PTClose:
-			s.clientClose = true
-			s.Close()
-			rc.Close()
-			continue
+			if s.currentConn() != conn {
+				// the old conn was closed by a successful upgrade
+				s.logger.Debug("NextReader upgraded")
+				continue
+			}
+			return 0, 0, nil, err
 		}
-
 		return mt, pt, rc, nil
 	}
 }
 
+// ReadMessage returns the next message queued by the session's read loop.
+// It must not be used when the server has a Handler, which receives the messages instead.
+// Once the session is closed and the queue is drained, it returns an error wrapping ErrTransportError.
 func (s *Session) ReadMessage() (message.MessageType, []byte, error) {
-	mt, _, r, err := s.nextReader()
-	if err != nil {
-		return mt, nil, err
+	return s.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext is ReadMessage giving up with ctx's error when ctx is done.
+func (s *Session) ReadMessageContext(ctx context.Context) (message.MessageType, []byte, error) {
+	select {
+	case msg := <-s.recvCh:
+		return msg.Type, msg.Data, nil
+	default:
 	}
 
-	defer r.Close()
-	bs, err := io.ReadAll(r)
-	if err != nil {
-		return mt, nil, err
+	select {
+	case msg := <-s.recvCh:
+		return msg.Type, msg.Data, nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case <-s.closeCh:
+		select {
+		case msg := <-s.recvCh:
+			return msg.Type, msg.Data, nil
+		default:
+			return 0, nil, s.readError()
+		}
 	}
+}
 
-	return mt, bs, err
+func (s *Session) readError() error {
+	err := s.CloseError()
+	if err == nil {
+		err = ErrSessionClosed
+	}
+	return errors.Join(err, ErrTransportError)
 }
 
+// Upgrade probes reqTransport and moves the session onto it.
+// If the probe fails or exceeds the server's upgrade timeout, the new conn is discarded
+// and the session carries on over the old one.
 func (s *Session) Upgrade(w http.ResponseWriter, r *http.Request, reqTransport transport.Transport) error {
-	// stop heartbeat
-	close(s.closeCh)
+	if !s.upgrading.CompareAndSwap(false, true) {
+		return ErrUpgrading
+	}
+	defer s.upgrading.Store(false)
+	s.server.loops.add()
+	defer s.server.loops.done()
 
-	// conn
-	oldConn := s.conn
-	s.upgradeLock.Lock()
 	newConn, err := reqTransport.Accept(w, r)
 	if err != nil {
 		return err
 	}
+	newConn.SetReadLimit(s.conf.MaxPayload)
+
+	// stop heartbeat
+	close(s.heartbeatCh)
 
-	// wait for ping
+	timer := time.NewTimer(s.server.upgradeTimeout)
+	defer timer.Stop()
+
+	// wait for ping, send pong
 	s.logger.Debug("[UPGRADE] 1", time.Now().UnixMilli())
-	mt, pt, rc, err := newConn.NextReader()
+	if err := s.awaitUpgrade(timer, func() error { return probe(newConn) }); err != nil {
+		return s.abortUpgrade(newConn, nil, err)
+	}
+
+	// pause old
+	s.logger.Debug("[UPGRADE] 2", time.Now().UnixMilli())
+	s.upgradeLock.Lock()
+	oldConn := s.conn
+	oldConn.Pause()
+
+	// wait for upgrade
+	s.logger.Debug("[UPGRADE] 3", time.Now().UnixMilli())
+	if err := s.awaitUpgrade(timer, func() error { return expect(newConn, message.PTUpgrade) }); err != nil {
+		return s.abortUpgrade(newConn, oldConn, err)
+	}
+
+	// replace conn
+	s.logger.Debug("[UPGRADE] 4", time.Now().UnixMilli())
+	s.connLock.Lock()
+	s.conn = newConn
+	s.connLock.Unlock()
+	s.heartbeatCh = make(chan struct{})
+	s.upgradeLock.Unlock()
+	go oldConn.Close(false)
+
+	// restart heatbeat
+	s.logger.Debug("[UPGRADE] 5", time.Now().UnixMilli())
+	s.startHeartbeat()
+
+	if s.mailbox != nil {
+		s.dispatchUpgrade()
+	}
+
+	return nil
+}
+
+// awaitUpgrade runs step until it returns, the upgrade times out or the session closes.
+func (s *Session) awaitUpgrade(timer *time.Timer, step func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- step()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		return ErrUpgradeTimeout
+	case <-s.closeCh:
+		return ErrSessionClosed
+	}
+}
+
+// abortUpgrade discards newConn and resumes the paused oldConn, if any, with the heartbeat.
+func (s *Session) abortUpgrade(newConn, oldConn transport.Conn, err error) error {
+	s.logger.Debug("[UPGRADE] failed ", err)
+	newConn.Close(false)
+
+	if oldConn != nil {
+		oldConn.Resume()
+	} else {
+		s.upgradeLock.Lock()
+	}
+	s.heartbeatCh = make(chan struct{})
+	s.upgradeLock.Unlock()
+	s.startHeartbeat()
+
+	if fn := s.server.onUpgradeFailed; fn != nil {
+		fn(s, err)
+	}
+	return err
+}
+
+// probe answers the client's "2probe" ping on conn.
+func probe(conn transport.Conn) error {
+	mt, pt, rc, err := conn.NextReader()
 	if err != nil {
 		return err
 	}
+	defer rc.Close()
 	if mt != message.MTText || pt != message.PTPing {
 		return errors.New("upgrade rcv ping error")
 	}
 
-	// send pong
-	s.logger.Debug("[UPGRADE] 2", time.Now().UnixMilli())
-	wc, err := newConn.NextWriter(message.MTText, message.PTPong)
+	bs, err := io.ReadAll(rc)
 	if err != nil {
 		return err
 	}
-	bs, err := io.ReadAll(rc)
+	wc, err := conn.NextWriter(message.MTText, message.PTPong)
 	if err != nil {
 		return err
 	}
 	if _, err := wc.Write(bs); err != nil {
+		wc.Close()
 		return err
 	}
-	wc.Close()
-
-	// pause old
-	oldConn.Pause()
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	d := conn.Flush()
+	<-d.Done()
+	return d.Err()
+}
 
-	// wait for upgrade
-	s.logger.Debug("[UPGRADE] 3", time.Now().UnixMilli())
-	mt, pt, rc, err = newConn.NextReader()
+// expect reads the next packet from conn and checks it is pt.
+func expect(conn transport.Conn, pt message.PacketType) error {
+	mt, rpt, rc, err := conn.NextReader()
 	if err != nil {
 		return err
 	}
-	if mt != message.MTText || pt != message.PTUpgrade {
+	rc.Close()
+	if mt != message.MTText || rpt != pt {
 		return errors.New("upgrade rcv upgrade error")
 	}
-	rc.Close()
-
-	// replace conn
-	s.logger.Debug("[UPGRADE] 4", time.Now().UnixMilli())
-	s.conn = newConn
-	s.closeCh = make(chan struct{})
-	s.upgradeLock.Unlock()
-	go oldConn.Close(false)
-
-	// restart heatbeat
-	s.logger.Debug("[UPGRADE] 5", time.Now().UnixMilli())
-	go s.Ping()
-
 	return nil
 }
 
 func (s *Session) Transport() string {
-	return s.conn.Name()
+	return s.currentConn().Name()
 }
 
+// Close closes the session with ReasonForcedClose.
 func (s *Session) Close() error {
+	s.close(ReasonForcedClose, nil)
+	return nil
+}
+
+// close closes the session once, recording reason and the underlying err,
+// then runs the server's OnClose callback.
+func (s *Session) close(reason CloseReason, err error) {
+	s.closeLock.Lock()
 	select {
 	case <-s.closeCh:
-		return nil
+		s.closeLock.Unlock()
+		return
 	default:
-		s.logger.Debug("Session close", s.clientClose)
-		s.server.removeSession(s)
-		close(s.closeCh)
-		s.conn.Close(s.clientClose)
-		return nil
 	}
+
+	s.logger.Debug("Session close ", reason, err)
+	s.closeReason = reason
+	s.closeErr = err
+	s.server.removeSession(s)
+	close(s.closeCh)
+	s.cancel()
+	s.closeLock.Unlock()
+
+	// a websocket close may wait out a slow write, so it is not done under closeLock
+	s.currentConn().Close(s.clientClose.Load())
+
+	if fn := s.server.onClose; fn != nil {
+		fn(s, reason, err)
+	}
+	if s.mailbox != nil {
+		s.dispatchClose(reason)
+	}
+}
+
+// CloseReason returns why the session ended, or "" while it is open.
+func (s *Session) CloseReason() CloseReason {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	return s.closeReason
+}
+
+// CloseError returns the error that ended the session, if any.
+func (s *Session) CloseError() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	return s.closeErr
 }
 
 func (s *Session) Unique(method string) (ok bool) {
-	if s.conn.Name() == "websocket" {
+	if s.currentConn().Name() == "websocket" {
 		return false
 	}
 
@@ -249,44 +430,95 @@ func (s *Session) UnlockMethod(method string) {
 	}
 }
 
+// Ping runs the heartbeat until the session closes or an upgrade stops it.
+// In v4 the server pings, in v3 it waits for the client's pings.
 func (s *Session) Ping() {
+	s.heartbeat(s.heartbeatCh)
+}
+
+// startHeartbeat runs the heartbeat in the background until the session closes or heartbeatCh is closed.
+func (s *Session) startHeartbeat() {
+	stop := s.heartbeatCh
+	s.server.loops.Go(func() {
+		s.heartbeat(stop)
+	})
+}
+
+func (s *Session) heartbeat(stop <-chan struct{}) {
+	if s.proto == transport.Protocol3 {
+		s.expectPing(stop)
+		return
+	}
+
 	ticker := time.NewTicker(time.Duration(s.conf.PingInterval) * time.Millisecond)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-s.closeCh:
 			return
+		case <-stop:
+			return
 		case <-ticker.C:
-			go s.ping()
+			s.server.loops.Go(func() {
+				s.ping(stop)
+			})
 		}
 	}
 }
 
-func (s *Session) ping() {
+func (s *Session) ping(stop <-chan struct{}) {
 	timeoutTimer := time.NewTimer(time.Duration(s.conf.PingTimeout) * time.Millisecond)
 
 	defer timeoutTimer.Stop()
 
+	select {
+	case <-s.pongCh:
+		// stale pong
+	default:
+	}
+
 	s.logger.Debug("[Ping]")
-	go func() {
-		w, err := s.conn.NextWriter(message.MTText, message.PTPing)
-		if err != nil {
-			return
-		}
-		w.Write(nil)
-		w.Close()
-	}()
+	go s.send(&packet{mt: message.MTText, pt: message.PTPing})
 
 	select {
 	case <-s.closeCh:
 		// closed somewhere else
 		return
+	case <-stop:
+		// upgrading
+		return
 	case <-timeoutTimer.C:
 		// time out
 		s.logger.Debug("[Ping] Timedout")
-		s.Close()
+		s.close(ReasonPingTimeout, nil)
 		return
 	case <-s.pongCh:
 		// normal
 		return
 	}
 }
+
+func (s *Session) expectPing(stop <-chan struct{}) {
+	timeout := time.Duration(s.conf.PingInterval+s.conf.PingTimeout) * time.Millisecond
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-stop:
+			return
+		case <-timeoutTimer.C:
+			s.logger.Debug("[Ping] Timedout")
+			s.close(ReasonPingTimeout, nil)
+			return
+		case <-s.pongCh:
+			if !timeoutTimer.Stop() {
+				<-timeoutTimer.C
+			}
+			timeoutTimer.Reset(timeout)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package engineigo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
+	"github.com/taogames/engine.igo/transport/polling"
+)
+
+// slowCloseTransport is polling whose conns take until release is closed to close.
+type slowCloseTransport struct {
+	release chan struct{}
+}
+
+func (t *slowCloseTransport) Name() string {
+	return "polling"
+}
+
+func (t *slowCloseTransport) Accept(w http.ResponseWriter, r *http.Request) (transport.Conn, error) {
+	conn, err := polling.Default.Accept(w, r)
+	return &slowCloseConn{Conn: conn, release: t.release}, err
+}
+
+type slowCloseConn struct {
+	transport.Conn
+	release chan struct{}
+}
+
+func (c *slowCloseConn) Close(noop bool) error {
+	<-c.release
+	return c.Conn.Close(noop)
+}
+
+func TestCloseReasonWhileConnCloses(t *testing.T) {
+	tr := &slowCloseTransport{release: make(chan struct{})}
+	defer close(tr.release)
+	s, ts := newTestServer(t, WithTransports(tr))
+	sess, _ := handshake(t, s, ts)
+
+	go sess.Close()
+
+	got := make(chan CloseReason, 1)
+	go func() {
+		for sess.CloseReason() == "" {
+			time.Sleep(time.Millisecond)
+		}
+		got <- sess.CloseReason()
+	}()
+	select {
+	case reason := <-got:
+		if reason != ReasonForcedClose {
+			t.Errorf("CloseReason = %q, want %q", reason, ReasonForcedClose)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseReason blocked while the conn was closing")
+	}
+	if err := sess.CloseError(); err != nil {
+		t.Errorf("CloseError = %v", err)
+	}
+}
+
+// heldTransport is polling whose conns stop taking packets while it is held.
+// held is signalled whenever a write starts waiting.
+type heldTransport struct {
+	mu      sync.Mutex
+	release chan struct{}
+	held    chan struct{}
+}
+
+func (t *heldTransport) Name() string {
+	return "polling"
+}
+
+func (t *heldTransport) Accept(w http.ResponseWriter, r *http.Request) (transport.Conn, error) {
+	conn, err := polling.Default.Accept(w, r)
+	return &heldConn{Conn: conn, t: t}, err
+}
+
+func (t *heldTransport) hold() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.release = make(chan struct{})
+	t.held = make(chan struct{}, 1)
+}
+
+func (t *heldTransport) unhold() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	close(t.release)
+	t.release = nil
+}
+
+type heldConn struct {
+	transport.Conn
+	t *heldTransport
+}
+
+func (c *heldConn) NextWriter(mt message.MessageType, pt message.PacketType) (io.WriteCloser, error) {
+	c.t.mu.Lock()
+	release, held := c.t.release, c.t.held
+	c.t.mu.Unlock()
+	if release != nil {
+		select {
+		case held <- struct{}{}:
+		default:
+		}
+		<-release
+	}
+	return c.Conn.NextWriter(mt, pt)
+}
+
+func text(data string) *message.Message {
+	return &message.Message{Type: message.MTText, Data: []byte(data)}
+}
+
+func TestWriteMessageContextWithdrawn(t *testing.T) {
+	tr := &heldTransport{}
+	s, ts := newTestServer(t, WithTransports(tr))
+	sess, sid := handshake(t, s, ts)
+
+	// the write loop is stuck writing "a"
+	tr.hold()
+	sess.WriteMessage(text("a"))
+	<-tr.held
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sess.WriteMessageContext(ctx, text("withdrawn")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WriteMessageContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+	tr.unhold()
+
+	sess.WriteMessage(text("b"))
+	if body := poll(t, ts, sid); body != "4a\x1e4b" {
+		t.Errorf("GET = %q, want %q", body, "4a\x1e4b")
+	}
+}
+
+func TestWriteMessageContextTaken(t *testing.T) {
+	tr := &heldTransport{}
+	s, ts := newTestServer(t, WithTransports(tr))
+	sess, sid := handshake(t, s, ts)
+
+	tr.hold()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- sess.WriteMessageContext(ctx, text("taken"))
+	}()
+	// the write loop is writing it when the writer gives up
+	<-tr.held
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteMessageContext = %v, want %v", err, context.Canceled)
+	}
+	tr.unhold()
+
+	sess.WriteMessage(text("next"))
+	if body := poll(t, ts, sid); body != "4taken\x1e4next" {
+		t.Errorf("GET = %q, want %q", body, "4taken\x1e4next")
+	}
+}
+
+func TestWriteMessageContextDelivered(t *testing.T) {
+	s, ts := newTestServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- sess.WriteMessageContext(context.Background(), text("a"))
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("WriteMessageContext returned %v before a GET", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if body := poll(t, ts, sid); body != "4a" {
+		t.Errorf("GET = %q, want %q", body, "4a")
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("WriteMessageContext = %v", err)
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+	s, ts := newTestServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := sess.ReadMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadMessageContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	post(t, ts, sid, "4a")
+	if _, data, err := sess.ReadMessageContext(context.Background()); err != nil || string(data) != "a" {
+		t.Fatalf("ReadMessageContext = %q %v", data, err)
+	}
+
+	// queued messages are still read once the session is closed
+	post(t, ts, sid, "4b")
+	deadline := time.Now().Add(time.Second)
+	for len(sess.recvCh) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sess.Close()
+	if _, data, err := sess.ReadMessageContext(context.Background()); err != nil || string(data) != "b" {
+		t.Fatalf("ReadMessageContext after close = %q %v", data, err)
+	}
+	if _, _, err := sess.ReadMessageContext(context.Background()); !errors.Is(err, ErrTransportError) {
+		t.Errorf("ReadMessageContext on a drained closed session = %v, want %v", err, ErrTransportError)
+	}
+}
+
+func TestContextCancelledOnClose(t *testing.T) {
+	s, ts := newTestServer(t)
+	sess, _ := handshake(t, s, ts)
+
+	ctx := sess.Context()
+	select {
+	case <-ctx.Done():
+		t.Fatal("context done while the session is open")
+	default:
+	}
+	sess.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on close")
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Errorf("ctx.Err() = %v", ctx.Err())
+	}
+}
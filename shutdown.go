@@ -0,0 +1,133 @@
+package engineigo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/taogames/engine.igo/message"
+)
+
+// group counts running goroutines. Unlike sync.WaitGroup, it may grow while someone waits.
+type group struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (g *group) add() {
+	g.mu.Lock()
+	g.n++
+	g.mu.Unlock()
+}
+
+func (g *group) done() {
+	g.mu.Lock()
+	g.n--
+	if g.n == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+	g.mu.Unlock()
+}
+
+func (g *group) Go(fn func()) {
+	g.add()
+	go func() {
+		defer g.done()
+		fn()
+	}()
+}
+
+// wait returns once no goroutine is running, or with ctx's error.
+func (g *group) wait(ctx context.Context) error {
+	g.mu.Lock()
+	if g.n == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the server gracefully. New handshakes are refused with ErrServerShuttingDown,
+// then every session is sent a CLOSE packet behind its queued packets and closed with ReasonServerShutdown.
+// Shutdown waits for the sessions' goroutines to exit and the Handler's events to run, or for ctx to be done,
+// before closing the Accept channel.
+// Requests for existing sessions keep being served meanwhile, so polling clients can collect their last packets.
+// Like http.Server.Shutdown, it returns ctx's error if ctx was done before every session was drained.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownLock.Lock()
+	s.shuttingDown = true
+	s.shutdownLock.Unlock()
+
+	var (
+		wg  sync.WaitGroup
+		cut atomic.Bool
+	)
+	for _, sess := range s.sessions.snapshot() {
+		wg.Add(1)
+		go func(sess *Session) {
+			defer wg.Done()
+			if err := sess.drain(ctx, ReasonServerShutdown); err != nil {
+				cut.Store(true)
+			}
+		}(sess)
+	}
+	wg.Wait()
+
+	err := s.loops.wait(ctx)
+	if d := s.dispatcher; d != nil {
+		if derr := d.pending.wait(ctx); err == nil {
+			err = derr
+		}
+		d.stop()
+	}
+	if err == nil && cut.Load() {
+		err = ctx.Err()
+	}
+
+	// every session is closed by now, so the pending Accept sends give up at once
+	s.accepting.wait(context.Background())
+	s.acceptOnce.Do(func() {
+		close(s.sessCh)
+	})
+	return err
+}
+
+// drain queues a CLOSE packet behind the packets already queued and waits for it to be flushed,
+// or for ctx to be done, then closes the session with reason.
+// It returns ctx's error if ctx cut the flush short.
+func (s *Session) drain(ctx context.Context, reason CloseReason) error {
+	defer s.close(reason, nil)
+
+	p := &packet{mt: message.MTText, pt: message.PTClose, done: make(chan struct{})}
+	if err := s.sendContext(ctx, p); err != nil {
+		if errors.Is(err, ErrSessionClosed) {
+			return nil
+		}
+		return err
+	}
+
+	select {
+	case <-p.done:
+		// the client has its CLOSE, closing the conn must not send another
+		s.clientClose.Store(true)
+		return nil
+	case <-s.closeCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,64 @@
+package engineigo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/taogames/engine.igo/message"
+)
+
+func TestShutdownDrained(t *testing.T) {
+	s, ts := newTestServer(t)
+	accepted := make(chan *Session, 1)
+	go func() {
+		for sess := range s.Accept() {
+			accepted <- sess
+		}
+		close(accepted)
+	}()
+
+	c, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.ReadMessage()
+	sess := <-accepted
+	sess.WriteMessage(&message.Message{Type: message.MTText, Data: []byte("bye")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	for _, want := range []string{"4bye", "1"} {
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("read %q %v, want %q", data, err, want)
+		}
+	}
+	if reason := sess.CloseReason(); reason != ReasonServerShutdown {
+		t.Errorf("CloseReason = %q", reason)
+	}
+	if _, ok := <-accepted; ok {
+		t.Error("Accept channel not closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, ts := newTestServer(t)
+	// a polling client that never polls again cannot be drained
+	sess, _ := handshake(t, s, ts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if reason := sess.CloseReason(); reason != ReasonServerShutdown {
+		t.Errorf("CloseReason = %q", reason)
+	}
+}
@@ -1,22 +1,100 @@
 package transport
 
+import (
+	"fmt"
+)
+
+// Manager holds the registered transports and the graph of upgrades between them.
 type Manager struct {
 	m map[string]Transport
 
-	upgradeList []string
+	upgrades map[string][]string
 }
 
+// NewManager registers ts and lets each transport upgrade to every transport after it.
 func NewManager(ts []Transport) *Manager {
+	upgrades := make(map[string][]string, len(ts))
+	for i, t := range ts {
+		for _, to := range ts[i+1:] {
+			upgrades[t.Name()] = append(upgrades[t.Name()], to.Name())
+		}
+	}
+
+	m, err := NewGraphManager(ts, upgrades)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// NewGraphManager registers ts with an explicit upgrade graph, mapping a transport to the ones it may upgrade to.
+// Every name in the graph must be registered, and the graph must be acyclic.
+// Websocket cannot be upgraded from, since its conn cannot be paused,
+// and polling cannot be upgraded to, since it cannot answer a probe.
+func NewGraphManager(ts []Transport, upgrades map[string][]string) (*Manager, error) {
 	manager := &Manager{
-		m:           make(map[string]Transport),
-		upgradeList: make([]string, len(ts)),
+		m:        make(map[string]Transport, len(ts)),
+		upgrades: make(map[string][]string, len(upgrades)),
 	}
-	for i, t := range ts {
+	for _, t := range ts {
+		if _, ok := manager.m[t.Name()]; ok {
+			return nil, fmt.Errorf("transport %q registered twice", t.Name())
+		}
 		manager.m[t.Name()] = t
-		manager.upgradeList[i] = t.Name()
 	}
 
-	return manager
+	for from, tos := range upgrades {
+		if _, ok := manager.m[from]; !ok {
+			return nil, fmt.Errorf("upgrade from unknown transport %q", from)
+		}
+		for _, to := range tos {
+			if _, ok := manager.m[to]; !ok {
+				return nil, fmt.Errorf("upgrade from %q to unknown transport %q", from, to)
+			}
+			if from == "websocket" || to == "polling" {
+				return nil, fmt.Errorf("upgrade from %q to %q is not supported", from, to)
+			}
+		}
+		manager.upgrades[from] = append([]string(nil), tos...)
+	}
+
+	if err := manager.checkAcyclic(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+func (m *Manager) checkAcyclic() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(m.m))
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("upgrade cycle through transport %q", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, to := range m.upgrades[name] {
+			if err := visit(to); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+
+	for name := range m.upgrades {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *Manager) Get(name string) (Transport, bool) {
@@ -24,21 +102,24 @@ func (m *Manager) Get(name string) (Transport, bool) {
 	return t, ok
 }
 
+// Upgradable returns the transports name may upgrade to.
 func (m *Manager) Upgradable(name string) []string {
-	for i, v := range m.upgradeList {
-		if v == name {
-			return m.upgradeList[i+1:]
-		}
+	tos := m.upgrades[name]
+	if len(tos) == 0 {
+		return []string{}
 	}
-
-	return []string{}
+	return append([]string(nil), tos...)
 }
 
+// CanUpgrade reports whether the graph has an upgrade from one registered transport to another.
 func (m *Manager) CanUpgrade(from, to string) bool {
-	for i := 0; i < len(m.upgradeList) && m.upgradeList[i] != from; i++ {
-		if m.upgradeList[i] == to {
-			return false
+	if _, ok := m.m[to]; !ok {
+		return false
+	}
+	for _, v := range m.upgrades[from] {
+		if v == to {
+			return true
 		}
 	}
-	return true
+	return false
 }
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type namedTransport string
+
+func (t namedTransport) Name() string {
+	return string(t)
+}
+
+func (t namedTransport) Accept(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	return nil, nil
+}
+
+func transports(names ...string) []Transport {
+	ts := make([]Transport, len(names))
+	for i, name := range names {
+		ts[i] = namedTransport(name)
+	}
+	return ts
+}
+
+func TestNewGraphManagerRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		ts       []Transport
+		upgrades map[string][]string
+	}{
+		{"duplicate name", transports("polling", "websocket", "polling"), nil},
+		{"unknown from", transports("polling", "websocket"), map[string][]string{"webtransport": {"websocket"}}},
+		{"unknown to", transports("polling", "websocket"), map[string][]string{"polling": {"webtransport"}}},
+		{"cycle", transports("polling", "a", "b"), map[string][]string{"a": {"b"}, "b": {"a"}}},
+		{"self upgrade", transports("polling", "a"), map[string][]string{"a": {"a"}}},
+		{"from websocket", transports("polling", "websocket", "a"), map[string][]string{"websocket": {"a"}}},
+		{"to polling", transports("polling", "a"), map[string][]string{"a": {"polling"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewGraphManager(tt.ts, tt.upgrades); err == nil {
+				t.Fatal("NewGraphManager accepted the graph")
+			}
+		})
+	}
+}
+
+func TestNewGraphManager(t *testing.T) {
+	m, err := NewGraphManager(transports("polling", "a", "websocket"), map[string][]string{
+		"polling": {"a", "websocket"},
+		"a":       {"websocket"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := m.Upgradable("polling"), []string{"a", "websocket"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Upgradable(polling) = %v, want %v", got, want)
+	}
+	if got := m.Upgradable("websocket"); got == nil || len(got) != 0 {
+		t.Errorf("Upgradable(websocket) = %#v, want empty", got)
+	}
+	for _, tt := range []struct {
+		from, to string
+		want     bool
+	}{
+		{"polling", "a", true},
+		{"a", "websocket", true},
+		{"websocket", "a", false},
+		{"a", "polling", false},
+		{"polling", "webtransport", false},
+	} {
+		if got := m.CanUpgrade(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanUpgrade(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestNewGraphManagerWithoutUpgrades(t *testing.T) {
+	m, err := NewGraphManager(transports("polling", "websocket"), map[string][]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Upgradable("polling"); len(got) != 0 {
+		t.Errorf("Upgradable(polling) = %v, want none", got)
+	}
+	if m.CanUpgrade("polling", "websocket") {
+		t.Error("CanUpgrade(polling, websocket) with upgrades disabled")
+	}
+	if _, ok := m.Get("websocket"); !ok {
+		t.Error("websocket not registered")
+	}
+}
+
+func TestNewManager(t *testing.T) {
+	m := NewManager(transports("polling", "websocket"))
+	if !m.CanUpgrade("polling", "websocket") {
+		t.Error("CanUpgrade(polling, websocket) = false")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("NewManager accepted an upgrade from websocket to polling")
+		}
+	}()
+	NewManager(transports("websocket", "polling"))
+}
@@ -0,0 +1,109 @@
+package polling
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressionThreshold is the smallest GET response body compressed, in bytes.
+const DefaultCompressionThreshold = 1024
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, "" if neither is accepted.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[name] = true
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses response bodies of at least threshold bytes.
+// The payload writes every body in a single Write, so the decision is made there,
+// and the status code is held back until it is known.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding  string
+	threshold int
+
+	status      int
+	wroteHeader bool
+}
+
+func newCompressWriter(w http.ResponseWriter, encoding string, threshold int) *compressWriter {
+	return &compressWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+		threshold:      threshold,
+		status:         http.StatusOK,
+	}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(bs []byte) (int, error) {
+	if w.wroteHeader || len(bs) < w.threshold {
+		w.finish()
+		return w.ResponseWriter.Write(bs)
+	}
+
+	var buf bytes.Buffer
+	if err := w.compress(&buf, bs); err != nil {
+		return 0, err
+	}
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	w.finish()
+
+	if _, err := w.ResponseWriter.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+func (w *compressWriter) compress(dst io.Writer, bs []byte) error {
+	// Content-Encoding deflate is the zlib format, not raw DEFLATE (RFC 9110 8.4.1.2)
+	var zw io.WriteCloser
+	switch w.encoding {
+	case "gzip":
+		zw = gzip.NewWriter(dst)
+	default:
+		zw = zlib.NewWriter(dst)
+	}
+
+	if _, err := zw.Write(bs); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// finish writes the held back status code, if it has not been written yet.
+func (w *compressWriter) finish() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
@@ -0,0 +1,122 @@
+package polling
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/taogames/engine.igo/message"
+)
+
+// poll writes packets to a new conn of t and returns the response to a GET sending acceptEncoding.
+func poll(t *testing.T, tr *Transport, acceptEncoding string, packets ...string) *http.Response {
+	t.Helper()
+	handshake := httptest.NewRequest(http.MethodGet, "/?EIO=4&transport=polling", nil)
+	conn, err := tr.Accept(httptest.NewRecorder(), handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range packets {
+		w, err := conn.NextWriter(message.MTText, message.PTMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(p))
+		w.Close()
+	}
+	d := conn.Flush()
+
+	r := httptest.NewRequest(http.MethodGet, "/?EIO=4&transport=polling", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	rec := httptest.NewRecorder()
+	if err := conn.ServeHTTP(rec, r); err != nil {
+		t.Fatal(err)
+	}
+	<-d.Done()
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result()
+}
+
+func decodeBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var r io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestCompressEncodings(t *testing.T) {
+	data := strings.Repeat("x", 2*DefaultCompressionThreshold)
+	tr := &Transport{Compress: true}
+
+	for _, tt := range []struct {
+		accept string
+		want   string
+	}{
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip;q=0.5", "gzip"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"br", ""},
+		{"", ""},
+	} {
+		resp := poll(t, tr, tt.accept, data)
+		if got := resp.Header.Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", tt.accept, got, tt.want)
+		}
+		if got := decodeBody(t, resp); got != "4"+data {
+			t.Errorf("Accept-Encoding %q: body of %d bytes, want %d", tt.accept, len(got), len(data)+1)
+		}
+	}
+}
+
+func TestCompressThresholdMultiPacket(t *testing.T) {
+	tr := &Transport{Compress: true, CompressionThreshold: 100}
+	small := strings.Repeat("a", 40)
+
+	// every packet is below the threshold, the payload is not
+	resp := poll(t, tr, "gzip", small, small, small)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("payload of 3 packets not compressed")
+	}
+	want := strings.Join([]string{"4" + small, "4" + small, "4" + small}, "\x1e")
+	if got := decodeBody(t, resp); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+
+	resp = poll(t, tr, "gzip", small, small)
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("payload below the threshold compressed")
+	}
+	if got := decodeBody(t, resp); got != "4"+small+"\x1e4"+small {
+		t.Errorf("body = %q", got)
+	}
+
+	resp = poll(t, &Transport{CompressionThreshold: 1}, "gzip", small, small, small)
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("compressed without Compress")
+	}
+}
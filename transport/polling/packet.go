@@ -1,35 +1,76 @@
 package polling
 
 import (
+	"bytes"
+	"encoding/base64"
 	"io"
 
 	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
 )
 
-type packetWriter struct {
-	w    io.Writer
-	pt   message.PacketType
-	done chan<- struct{}
+// Engine.IO v4 joins the packets of a polling payload with the record separator.
+const recordSeparator byte = 0x1e
+
+func encodePayload(packets [][]byte) []byte {
+	return bytes.Join(packets, []byte{recordSeparator})
 }
 
-func (w *packetWriter) Write(bs []byte) (int, error) {
-	n1, err := w.w.Write(w.pt.Bytes())
-	if err != nil {
-		return n1, err
+func decodePayload(bs []byte) []rawPacket {
+	parts := bytes.Split(bs, []byte{recordSeparator})
+	packets := make([]rawPacket, len(parts))
+	for i, part := range parts {
+		packets[i] = rawPacket{data: part}
 	}
+	return packets
+}
 
-	n2, err := w.w.Write(bs)
-	return n1 + n2, err
+// rawPacket is one packet cut out of a POST body.
+// binary is only set for v3 binary payloads, where the packet type is a raw byte.
+type rawPacket struct {
+	data   []byte
+	binary bool
 }
 
+type packetWriter struct {
+	payload *Payload
+	proto   int
+	mt      message.MessageType
+	pt      message.PacketType
+	buf     bytes.Buffer
+}
+
+func (w *packetWriter) Write(bs []byte) (int, error) {
+	return w.buf.Write(bs)
+}
+
+// Close queues the packet until the next Flush.
+// Binary packets are sent as 'b' followed by the base64 of the data,
+// v3 also keeps the packet type after the 'b'.
 func (w *packetWriter) Close() error {
-	w.done <- struct{}{}
-	return nil
+	var packet []byte
+	if w.mt == message.MTBinary {
+		prefix := []byte{'b'}
+		if w.proto == transport.Protocol3 {
+			prefix = append(prefix, w.pt.Bytes()...)
+		}
+		packet = make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(w.buf.Len()))
+		copy(packet, prefix)
+		base64.StdEncoding.Encode(packet[len(prefix):], w.buf.Bytes())
+	} else {
+		packet = make([]byte, 0, 1+w.buf.Len())
+		packet = append(packet, w.pt.Bytes()...)
+		packet = append(packet, w.buf.Bytes()...)
+	}
+
+	return w.payload.enqueue(packet)
 }
 
 type packetReader struct {
-	r     io.Reader
-	errCh chan<- error
+	r      io.Reader
+	proto  int
+	binary bool
+	errCh  chan<- error
 }
 
 func (r *packetReader) Read(bs []byte) (int, error) {
@@ -54,9 +95,29 @@ func (r *packetReader) parse() (message.MessageType, message.PacketType, io.Read
 		pt message.PacketType
 	)
 
-	if b == 'b' {
+	switch {
+	case r.binary:
 		mt = message.MTBinary
-	} else {
+		pt, err = message.ParsePacketType(b + '0')
+		if err != nil {
+			r.errCh <- err
+			return 0, 0, nil, err
+		}
+	case b == 'b':
+		mt = message.MTBinary
+		pt = message.PTMessage
+		if r.proto == transport.Protocol3 {
+			if _, err := r.Read(bs); err != nil {
+				r.errCh <- err
+				return 0, 0, nil, err
+			}
+			if pt, err = message.ParsePacketType(bs[0]); err != nil {
+				r.errCh <- err
+				return 0, 0, nil, err
+			}
+		}
+		r.r = base64.NewDecoder(base64.StdEncoding, r.r)
+	default:
 		mt = message.MTText
 		pt, err = message.ParsePacketType(b)
 		if err != nil {
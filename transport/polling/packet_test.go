@@ -0,0 +1,79 @@
+package polling
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []string
+		encoded string
+	}{
+		{"single", []string{"4hello"}, "4hello"},
+		{"several", []string{"2", "4hi", "6"}, "2\x1e4hi\x1e6"},
+		{"multi-byte", []string{"4é😀"}, "4é😀"},
+		{"base64 binary", []string{"bAQID", "4x"}, "bAQID\x1e4x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets := make([][]byte, len(tt.packets))
+			for i, p := range tt.packets {
+				packets[i] = []byte(p)
+			}
+			encoded := encodePayload(packets)
+			if string(encoded) != tt.encoded {
+				t.Fatalf("encode = %q, want %q", encoded, tt.encoded)
+			}
+
+			decoded := decodePayload(encoded)
+			if len(decoded) != len(tt.packets) {
+				t.Fatalf("decoded %d packets, want %d", len(decoded), len(tt.packets))
+			}
+			for i, p := range decoded {
+				if string(p.data) != tt.packets[i] {
+					t.Errorf("packet %d = %q, want %q", i, p.data, tt.packets[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBinaryPacket(t *testing.T) {
+	p := NewPayload(transport.Protocol4)
+	w, err := p.GetWriter(message.MTBinary, message.PTMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte{1, 2, 3})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	packet := p.pending.packets[0]
+	if string(packet) != "bAQID" {
+		t.Fatalf("encoded %q, want %q", packet, "bAQID")
+	}
+
+	r := &packetReader{r: bytes.NewReader(packet), proto: transport.Protocol4, errCh: make(chan error, 1)}
+	mt, pt, rc, err := r.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	if mt != message.MTBinary || pt != message.PTMessage || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("parse = %v %v %v", mt, pt, data)
+	}
+}
+
+func TestParseInvalidPacket(t *testing.T) {
+	r := &packetReader{r: bytes.NewReader([]byte("9x")), proto: transport.Protocol4, errCh: make(chan error, 1)}
+	if _, _, _, err := r.parse(); !errors.Is(err, message.ErrInvalidPacket) {
+		t.Fatalf("parse = %v, want ErrInvalidPacket", err)
+	}
+}
@@ -1,28 +1,61 @@
 package polling
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"net/http"
+	"sync"
 
 	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
 )
 
+// batch is the set of packets flushed together by one GET.
+// Batches flushed before a GET arrives are merged, so the GET takes all of them.
+type batch struct {
+	packets [][]byte
+	done    chan struct{}
+	err     error
+}
+
+func newBatch() *batch {
+	return &batch{
+		done: make(chan struct{}),
+	}
+}
+
+func (b *batch) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *batch) Err() error {
+	return b.err
+}
+
 type Payload struct {
-	writeCh   chan io.Writer
-	writeDone chan struct{}
+	proto int
+
+	mu      sync.Mutex
+	pending *batch
+	ready   *batch
+	notify  chan struct{}
 
 	readCh    chan *packetReader
 	readErrCh chan error
 
 	pauseCh chan struct{}
+	paused  bool
 
 	closeCh chan struct{}
 }
 
-func NewPayload() *Payload {
+func NewPayload(proto int) *Payload {
 	return &Payload{
-		writeCh:   make(chan io.Writer),
-		writeDone: make(chan struct{}),
+		proto: proto,
+
+		pending: newBatch(),
+		notify:  make(chan struct{}, 1),
 
 		readCh:    make(chan *packetReader),
 		readErrCh: make(chan error),
@@ -33,88 +66,247 @@ func NewPayload() *Payload {
 	}
 }
 
+func (p *Payload) state() error {
+	select {
+	case <-p.closeCh:
+		return ErrClose
+	case <-p.pauseCh:
+		return ErrUpgrade
+	default:
+		return nil
+	}
+}
+
+// enqueue adds an encoded packet to the pending batch.
+func (p *Payload) enqueue(packet []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.state(); err != nil {
+		return err
+	}
+	p.pending.packets = append(p.pending.packets, packet)
+	return nil
+}
+
+// Flush hands the pending batch to the next GET without waiting for it.
+// Until a GET arrives, later flushes join the same batch.
+func (p *Payload) Flush() transport.Delivery {
+	p.mu.Lock()
+	if err := p.state(); err != nil {
+		p.mu.Unlock()
+		return transport.Delivered(err)
+	}
+	if len(p.pending.packets) == 0 {
+		p.mu.Unlock()
+		return transport.Delivered(nil)
+	}
+	b := p.pending
+	p.pending = newBatch()
+	if p.ready != nil {
+		p.ready.packets = append(p.ready.packets, b.packets...)
+		b = p.ready
+	}
+	p.ready = b
+	p.mu.Unlock()
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+	return b
+}
+
+// take removes the batch waiting for a GET, if any.
+func (p *Payload) take() *batch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b := p.ready
+	p.ready = nil
+	return b
+}
+
+// abort fails every packet that has not been written to a GET yet.
+func (p *Payload) abort(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range []*batch{p.pending, p.ready} {
+		if b != nil {
+			b.err = err
+			close(b.done)
+		}
+	}
+	p.pending = newBatch()
+	p.ready = nil
+}
+
 func (p *Payload) Pause() {
+	p.mu.Lock()
+	if p.paused {
+		p.mu.Unlock()
+		return
+	}
+	p.paused = true
 	close(p.pauseCh)
+	p.mu.Unlock()
+
+	p.abort(ErrUpgrade)
 }
 
+// Resume undoes Pause after a failed upgrade.
+func (p *Payload) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		p.paused = false
+		p.pauseCh = make(chan struct{})
+	}
+}
+
+func (p *Payload) pauseChan() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pauseCh
+}
+
+// Close queues pt as the last packet for the next GET.
 func (p *Payload) Close(pt message.PacketType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	select {
 	case <-p.closeCh:
 		// no-op
-	case iow := <-p.writeCh:
-		w := packetWriter{
-			w:    iow,
-			pt:   pt,
-			done: p.writeDone,
-		}
-		defer w.Close()
-		w.Write(nil)
-
+		return
 	default:
-		close(p.closeCh)
 	}
+	if p.ready == nil {
+		p.ready = newBatch()
+	}
+	p.ready.packets = append(p.ready.packets, pt.Bytes())
+	close(p.closeCh)
 }
 
-func (p *Payload) PutWriter(w http.ResponseWriter) error {
+// PutWriter answers a GET with every packet flushed so far, waiting for one if there is none.
+// If ctx is done first, the GET is answered with a noop and the batch waits for the next one.
+func (p *Payload) PutWriter(ctx context.Context, w http.ResponseWriter) error {
+	pauseCh := p.pauseChan()
 	select {
-	case <-p.pauseCh:
-		w.WriteHeader(http.StatusOK)
-		w.Write(message.PTNoop.Bytes())
-		return nil
+	case <-pauseCh:
+		return p.writeNoop(w)
 	default:
 	}
 
-	select {
-	case <-p.pauseCh:
-		w.WriteHeader(http.StatusOK)
-		w.Write(message.PTNoop.Bytes())
-		return nil
-	case p.writeCh <- w:
-		<-p.writeDone
-		return nil
+	for {
+		select {
+		case <-ctx.Done():
+			return p.writeNoop(w)
+		case <-pauseCh:
+			return p.writeNoop(w)
+		case <-p.closeCh:
+			b := p.take()
+			if b == nil {
+				return p.writeNoop(w)
+			}
+			return b.flush(w, p.encode(b.packets))
+		case <-p.notify:
+			if b := p.take(); b != nil {
+				return b.flush(w, p.encode(b.packets))
+			}
+		}
 	}
 }
 
-func (p *Payload) GetWriter(pt message.PacketType) (io.WriteCloser, error) {
-	select {
-	case <-p.pauseCh:
-		return nil, ErrUpgrade
-	default:
-	}
+func (b *batch) flush(w http.ResponseWriter, body []byte) error {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, b.err = w.Write(body)
+	close(b.done)
+	return b.err
+}
 
-	select {
-	case <-p.pauseCh:
-		return nil, ErrUpgrade
-	case <-p.closeCh:
-		return nil, ErrClose
-	case w := <-p.writeCh:
-		return &packetWriter{
-			w:    w,
-			pt:   pt,
-			done: p.writeDone,
-		}, nil
+func (p *Payload) encode(packets [][]byte) []byte {
+	if p.proto == transport.Protocol3 {
+		return encodePayloadV3(packets)
 	}
+	return encodePayload(packets)
 }
 
-func (p *Payload) PutReader(r io.Reader) error {
-	p.readCh <- &packetReader{
-		r:     r,
-		errCh: p.readErrCh,
+func (p *Payload) decode(bs []byte, binary bool) ([]rawPacket, error) {
+	switch {
+	case p.proto != transport.Protocol3:
+		return decodePayload(bs), nil
+	case binary:
+		return decodeBinaryPayloadV3(bs)
+	default:
+		return decodePayloadV3(bs)
 	}
-	err := <-p.readErrCh
+}
+
+func (p *Payload) writeNoop(w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(p.encode([][]byte{message.PTNoop.Bytes()}))
 	return err
 }
 
-func (p *Payload) GetReader() (message.MessageType, message.PacketType, io.ReadCloser, error) {
-	select {
-	case <-p.pauseCh:
-		return 0, 0, nil, ErrUpgrade
-	default:
+func (p *Payload) GetWriter(mt message.MessageType, pt message.PacketType) (io.WriteCloser, error) {
+	p.mu.Lock()
+	err := p.state()
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &packetWriter{
+		payload: p,
+		proto:   p.proto,
+		mt:      mt,
+		pt:      pt,
+	}, nil
+}
+
+// PutReader hands every packet of a POST body to GetReader, one at a time, paused or not.
+// binary tells whether the body is a v3 application/octet-stream payload.
+func (p *Payload) PutReader(r io.Reader, binary bool) error {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	packets, err := p.decode(bs, binary)
+	if err != nil {
+		return err
 	}
 
+	for _, packet := range packets {
+		select {
+		case <-p.closeCh:
+			return ErrClose
+		case p.readCh <- &packetReader{
+			r:      bytes.NewReader(packet.data),
+			proto:  p.proto,
+			binary: packet.binary,
+			errCh:  p.readErrCh,
+		}:
+		}
+
+		if err := <-p.readErrCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetReader returns the next POSTed packet.
+// Pausing only stops writes: packets the client POSTs while an upgrade is under way
+// keep being read until the payload is closed.
+func (p *Payload) GetReader() (message.MessageType, message.PacketType, io.ReadCloser, error) {
 	select {
-	case <-p.pauseCh:
-		return 0, 0, nil, ErrUpgrade
+	case <-p.closeCh:
+		return 0, 0, nil, ErrClose
 	case r := <-p.readCh:
 		return r.parse()
 	}
@@ -1,11 +1,15 @@
 package polling
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
 )
 
 type serverConn struct {
@@ -13,6 +17,13 @@ type serverConn struct {
 
 	host       string
 	remoteAddr string
+	readLimit  int64
+
+	pollTimeout time.Duration
+	maxBodySize int64
+
+	compress          bool
+	compressThreshold int
 
 	pongCh    chan struct{}
 	closeType message.PacketType
@@ -21,12 +32,35 @@ type serverConn struct {
 func (c *serverConn) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case http.MethodGet:
-		if err := c.payload.PutWriter(w); err != nil {
+		ctx := r.Context()
+		if c.pollTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.pollTimeout)
+			defer cancel()
+		}
+		if c.compress {
+			if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding")); encoding != "" {
+				cw := newCompressWriter(w, encoding, c.compressThreshold)
+				defer cw.finish()
+				w = cw
+			}
+		}
+		if err := c.payload.PutWriter(ctx, w); err != nil {
 			return err
 		}
 
 	case http.MethodPost:
-		err := c.payload.PutReader(r.Body)
+		body := r.Body
+		if limit := c.bodyLimit(); limit > 0 {
+			body = http.MaxBytesReader(w, body, limit)
+		}
+		binary := r.Header.Get("Content-Type") == "application/octet-stream"
+		err := c.payload.PutReader(body, binary)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, transport.ErrPayloadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return transport.ErrPayloadTooLarge
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return err
@@ -46,7 +80,11 @@ func (c *serverConn) NextReader() (message.MessageType, message.PacketType, io.R
 }
 
 func (c *serverConn) NextWriter(mt message.MessageType, pt message.PacketType) (io.WriteCloser, error) {
-	return c.payload.GetWriter(pt)
+	return c.payload.GetWriter(mt, pt)
+}
+
+func (c *serverConn) Flush() transport.Delivery {
+	return c.payload.Flush()
 }
 
 func (c *serverConn) Close(noop bool) error {
@@ -59,6 +97,18 @@ func (c *serverConn) Close(noop bool) error {
 	return nil
 }
 
+func (c *serverConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// bodyLimit is the smaller of the session's read limit and the transport's MaxBodySize, 0 meaning no limit.
+func (c *serverConn) bodyLimit() int64 {
+	if c.maxBodySize > 0 && (c.readLimit <= 0 || c.maxBodySize < c.readLimit) {
+		return c.maxBodySize
+	}
+	return c.readLimit
+}
+
 func (c *serverConn) Name() string {
 	return "polling"
 }
@@ -66,3 +116,7 @@ func (c *serverConn) Name() string {
 func (c *serverConn) Pause() {
 	c.payload.Pause()
 }
+
+func (c *serverConn) Resume() {
+	c.payload.Resume()
+}
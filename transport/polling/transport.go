@@ -2,16 +2,30 @@ package polling
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/taogames/engine.igo/message"
 	"github.com/taogames/engine.igo/transport"
 )
 
 type Transport struct {
+	// PollTimeout answers a GET with a noop once it has waited this long, so idle proxies do not cut it.
+	// Zero lets a GET wait until there is something to send.
+	PollTimeout time.Duration
+
+	// MaxBodySize caps the size of a POST body below the server's max payload, if set.
+	MaxBodySize int64
+
+	// Compress gzips or deflates GET responses for clients that accept it.
+	Compress bool
+	// CompressionThreshold is the smallest response body compressed, DefaultCompressionThreshold if zero.
+	// It applies to the whole payload, however many packets it holds.
+	CompressionThreshold int
 }
 
 var _ transport.Transport = (*Transport)(nil)
 
+// Default is shared by every server that is not given its own Transport.
 var Default = &Transport{}
 
 func (t *Transport) Name() string {
@@ -20,11 +34,21 @@ func (t *Transport) Name() string {
 
 func (t *Transport) Accept(w http.ResponseWriter, r *http.Request) (transport.Conn, error) {
 	conn := &serverConn{
-		payload:    NewPayload(),
+		payload:    NewPayload(transport.ProtocolOf(r)),
 		host:       r.Host,
 		remoteAddr: r.RemoteAddr,
 		pongCh:     make(chan struct{}),
 		closeType:  message.PTClose,
+
+		pollTimeout: t.PollTimeout,
+		maxBodySize: t.MaxBodySize,
+
+		compress:          t.Compress,
+		compressThreshold: t.CompressionThreshold,
+	}
+
+	if conn.compressThreshold <= 0 {
+		conn.compressThreshold = DefaultCompressionThreshold
 	}
 
 	return conn, nil
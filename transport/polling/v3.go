@@ -0,0 +1,122 @@
+package polling
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/taogames/engine.igo/message"
+)
+
+var errPayloadV3 error = fmt.Errorf("%w: v3 payload", message.ErrInvalidPacket)
+
+// Engine.IO v3 prefixes every packet of a text payload with its length and a colon.
+// The length counts UTF-16 code units, as the JavaScript clients do.
+func encodePayloadV3(packets [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, packet := range packets {
+		buf.WriteString(strconv.Itoa(utf16Len(packet)))
+		buf.WriteByte(':')
+		buf.Write(packet)
+	}
+	return buf.Bytes()
+}
+
+func decodePayloadV3(bs []byte) ([]rawPacket, error) {
+	var packets []rawPacket
+	for len(bs) > 0 {
+		i := bytes.IndexByte(bs, ':')
+		if i < 0 {
+			return nil, errPayloadV3
+		}
+		n, err := strconv.Atoi(string(bs[:i]))
+		if err != nil || n < 1 {
+			return nil, errPayloadV3
+		}
+		bs = bs[i+1:]
+
+		size, ok := utf16Prefix(bs, n)
+		if !ok {
+			return nil, errPayloadV3
+		}
+		packets = append(packets, rawPacket{data: bs[:size]})
+		bs = bs[size:]
+	}
+	return packets, nil
+}
+
+// decodeBinaryPayloadV3 decodes the application/octet-stream payloads XHR2 clients POST.
+// Each packet is <0 string|1 binary><length digits as bytes><0xff><packet>.
+func decodeBinaryPayloadV3(bs []byte) ([]rawPacket, error) {
+	var packets []rawPacket
+	for len(bs) > 0 {
+		binary := bs[0] == 1
+		bs = bs[1:]
+
+		i := bytes.IndexByte(bs, 0xff)
+		if i < 0 {
+			return nil, errPayloadV3
+		}
+		n := 0
+		for _, d := range bs[:i] {
+			if d > 9 {
+				return nil, errPayloadV3
+			}
+			// a length beyond the body is malformed, and must not overflow
+			if n = n*10 + int(d); n > len(bs) {
+				return nil, errPayloadV3
+			}
+		}
+		if i == 0 || n < 1 {
+			return nil, errPayloadV3
+		}
+		bs = bs[i+1:]
+
+		size := n
+		if !binary {
+			var ok bool
+			if size, ok = utf16Prefix(bs, n); !ok {
+				return nil, errPayloadV3
+			}
+		}
+		if size > len(bs) {
+			return nil, errPayloadV3
+		}
+		packets = append(packets, rawPacket{data: bs[:size], binary: binary})
+		bs = bs[size:]
+	}
+	return packets, nil
+}
+
+func utf16Len(bs []byte) int {
+	n := 0
+	for len(bs) > 0 {
+		r, size := utf8.DecodeRune(bs)
+		bs = bs[size:]
+		n += utf16Units(r)
+	}
+	return n
+}
+
+// utf16Prefix returns how many bytes of bs hold the first n UTF-16 code units.
+// It fails if bs is shorter, or if n ends inside a surrogate pair.
+func utf16Prefix(bs []byte, n int) (int, bool) {
+	size, units := 0, 0
+	for units < n {
+		if size >= len(bs) {
+			return 0, false
+		}
+		r, s := utf8.DecodeRune(bs[size:])
+		size += s
+		units += utf16Units(r)
+	}
+	return size, units == n
+}
+
+func utf16Units(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
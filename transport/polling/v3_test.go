@@ -0,0 +1,134 @@
+package polling
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
+)
+
+func TestPayloadV3RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []string
+		encoded string
+	}{
+		{"single", []string{"4hello"}, "6:4hello"},
+		{"several", []string{"2", "4hi", "6"}, "1:23:4hi1:6"},
+		{"colons in data", []string{"4a:b", "4:"}, "4:4a:b2:4:"},
+		// é is one UTF-16 unit in two bytes, 😀 a surrogate pair in four bytes
+		{"multi-byte", []string{"4é", "4😀", "4a😀b"}, "2:4é3:4😀5:4a😀b"},
+		{"base64 binary", []string{"b4AQID"}, "6:b4AQID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets := make([][]byte, len(tt.packets))
+			for i, p := range tt.packets {
+				packets[i] = []byte(p)
+			}
+			encoded := encodePayloadV3(packets)
+			if string(encoded) != tt.encoded {
+				t.Fatalf("encode = %q, want %q", encoded, tt.encoded)
+			}
+
+			decoded, err := decodePayloadV3(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(tt.packets) {
+				t.Fatalf("decoded %d packets, want %d", len(decoded), len(tt.packets))
+			}
+			for i, p := range decoded {
+				if string(p.data) != tt.packets[i] || p.binary {
+					t.Errorf("packet %d = %q, want %q", i, p.data, tt.packets[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePayloadV3Malformed(t *testing.T) {
+	for _, bs := range []string{
+		"4hello",      // no length
+		"x:4hello",    // length not a number
+		"-1:4",        // negative length
+		"0:",          // empty packet
+		"9:4hello",    // length beyond the payload
+		"6:4hello3:4", // second packet truncated
+		"2:4😀",        // length ends inside a surrogate pair
+	} {
+		if _, err := decodePayloadV3([]byte(bs)); !errors.Is(err, message.ErrInvalidPacket) {
+			t.Errorf("decode %q: err = %v, want ErrInvalidPacket", bs, err)
+		}
+	}
+}
+
+func TestDecodeBinaryPayloadV3(t *testing.T) {
+	// a string packet "4hé" (3 units) followed by a binary message 0xde 0xad, its type as a raw byte
+	bs := []byte{0, 3, 0xff}
+	bs = append(bs, "4hé"...)
+	bs = append(bs, 1, 3, 0xff, 4, 0xde, 0xad)
+
+	packets, err := decodeBinaryPayloadV3(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("decoded %d packets, want 2", len(packets))
+	}
+	if string(packets[0].data) != "4hé" || packets[0].binary {
+		t.Errorf("packet 0 = %q binary=%v", packets[0].data, packets[0].binary)
+	}
+	if !bytes.Equal(packets[1].data, []byte{4, 0xde, 0xad}) || !packets[1].binary {
+		t.Errorf("packet 1 = %v binary=%v", packets[1].data, packets[1].binary)
+	}
+
+	for _, bs := range [][]byte{
+		{0, 3},             // no 0xff
+		{0, 0xff, '4'},     // no length digits
+		{0, 12, 0xff, '4'}, // digit out of range
+		{1, 9, 0xff, 4, 1}, // length beyond the payload
+		append(append([]byte{1}, bytes.Repeat([]byte{9}, 30)...), 0xff, 4), // length overflowing
+	} {
+		if _, err := decodeBinaryPayloadV3(bs); !errors.Is(err, message.ErrInvalidPacket) {
+			t.Errorf("decode %v: err = %v, want ErrInvalidPacket", bs, err)
+		}
+	}
+}
+
+func TestBinaryPacketV3(t *testing.T) {
+	p := NewPayload(transport.Protocol3)
+	w, err := p.GetWriter(message.MTBinary, message.PTMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte{1, 2, 3})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	packet := p.pending.packets[0]
+	if string(packet) != "b4AQID" {
+		t.Fatalf("encoded %q, want %q", packet, "b4AQID")
+	}
+
+	for _, raw := range []rawPacket{
+		{data: packet},
+		{data: []byte{4, 1, 2, 3}, binary: true},
+	} {
+		r := &packetReader{r: bytes.NewReader(raw.data), proto: transport.Protocol3, binary: raw.binary, errCh: make(chan error, 1)}
+		mt, pt, rc, err := r.parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != message.MTBinary || pt != message.PTMessage || !bytes.Equal(data, []byte{1, 2, 3}) {
+			t.Errorf("parse %q = %v %v %v", raw.data, mt, pt, data)
+		}
+	}
+}
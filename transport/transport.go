@@ -1,20 +1,80 @@
 package transport
 
 import (
+	"errors"
 	"io"
 	"net/http"
 
 	"github.com/taogames/engine.igo/message"
 )
 
+var (
+	ErrPayloadTooLarge error = errors.New("payload too large")
+	ErrPeerClosed      error = errors.New("transport closed by peer")
+)
+
+// Engine.IO protocol revisions.
+const (
+	Protocol3 = 3
+	Protocol4 = 4
+)
+
+// ProtocolOf returns the protocol revision requested by r's EIO query parameter, Protocol4 by default.
+func ProtocolOf(r *http.Request) int {
+	if r.URL.Query().Get("EIO") == "3" {
+		return Protocol3
+	}
+	return Protocol4
+}
+
 type Conn interface {
 	Name() string
 	ServeHTTP(w http.ResponseWriter, r *http.Request) error
 	Close(noop bool) error
 	Pause()
+	// Resume undoes Pause when an upgrade fails.
+	Resume()
+
+	// SetReadLimit sets the maximum size in bytes of a message read from the peer.
+	// Exceeding it fails the read with ErrPayloadTooLarge. A limit <= 0 means no limit.
+	SetReadLimit(limit int64)
 
 	NextReader() (message.MessageType, message.PacketType, io.ReadCloser, error)
 	NextWriter(mt message.MessageType, pt message.PacketType) (io.WriteCloser, error)
+	// Flush hands every packet written so far to the peer without waiting for it to take them.
+	// The returned Delivery completes once they have been handed over, or have failed.
+	Flush() Delivery
+}
+
+// Delivery tracks packets passed to Conn.Flush, like a context's Done and Err.
+type Delivery interface {
+	// Done is closed once the packets have been handed to the peer or have failed.
+	Done() <-chan struct{}
+	// Err returns why the packets failed, or nil. It is only meaningful once Done is closed.
+	Err() error
+}
+
+// Delivered returns a Delivery already completed with err, for transports that write synchronously.
+func Delivered(err error) Delivery {
+	return delivered{err: err}
+}
+
+type delivered struct {
+	err error
+}
+
+var closedCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+func (d delivered) Done() <-chan struct{} {
+	return closedCh
+}
+
+func (d delivered) Err() error {
+	return d.err
 }
 
 type Transport interface {
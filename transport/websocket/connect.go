@@ -1,59 +1,120 @@
 package websocket
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	gorilla "github.com/gorilla/websocket"
 	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
 )
 
+// Conn funnels every outgoing frame through a single write loop,
+// since gorilla allows only one concurrent writer.
 type Conn struct {
 	*gorilla.Conn
 
+	proto int
+
+	writeTimeout time.Duration
+	writeCh      chan *frame
+
+	// compressThreshold is the smallest frame compressed, when permessage-deflate was negotiated.
+	compressThreshold int
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
 	errCh chan error
 }
 
-func newConn(c *gorilla.Conn) *Conn {
-	return &Conn{
-		Conn:  c,
-		errCh: make(chan error),
+type frame struct {
+	mt   int
+	data []byte
+	done chan error
+}
+
+func newConn(c *gorilla.Conn, proto int, writeTimeout time.Duration, compressThreshold int) *Conn {
+	conn := &Conn{
+		Conn:              c,
+		proto:             proto,
+		writeTimeout:      writeTimeout,
+		writeCh:           make(chan *frame),
+		compressThreshold: compressThreshold,
+		closeCh:           make(chan struct{}),
+		errCh:             make(chan error),
 	}
+	go conn.writeLoop()
+
+	return conn
 }
 
-func (c *Conn) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
-	return <-c.errCh
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case f := <-c.writeCh:
+			c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			c.Conn.EnableWriteCompression(len(f.data) >= c.compressThreshold)
+			f.done <- c.Conn.WriteMessage(f.mt, f.data)
+		}
+	}
 }
 
-type wrapper struct {
-	w  io.WriteCloser
-	mt message.MessageType
-	pt message.PacketType
+// write hands a frame to the write loop and waits for it to be written.
+func (c *Conn) write(mt int, data []byte) error {
+	f := &frame{
+		mt:   mt,
+		data: data,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case <-c.closeCh:
+		return ErrClose
+	case c.writeCh <- f:
+	}
+	return <-f.done
 }
 
-func (w *wrapper) Write(bs []byte) (int, error) {
-	var n int
-	if w.mt == message.MTText {
-		n1, err := w.w.Write(w.pt.Bytes())
-		n += n1
-		if err != nil {
-			return n1, err
-		}
+func (c *Conn) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	select {
+	case err := <-c.errCh:
+		return err
+	case <-c.closeCh:
+		return nil
 	}
+}
 
-	n2, err := w.w.Write(bs)
-	n += n2
-	return n, err
+type writer struct {
+	c   *Conn
+	mt  message.MessageType
+	buf bytes.Buffer
 }
 
-func (w *wrapper) Close() error {
-	return w.w.Close()
+func (w *writer) Write(bs []byte) (int, error) {
+	return w.buf.Write(bs)
+}
+
+func (w *writer) Close() error {
+	return w.c.write(int(w.mt), w.buf.Bytes())
 }
 
 func (c *Conn) NextReader() (message.MessageType, message.PacketType, io.ReadCloser, error) {
 	mti, r, err := c.Conn.NextReader()
 	if err != nil {
+		if errors.Is(err, gorilla.ErrReadLimit) {
+			return 0, 0, nil, transport.ErrPayloadTooLarge
+		}
+		if gorilla.IsCloseError(err, gorilla.CloseNormalClosure, gorilla.CloseGoingAway, gorilla.CloseNoStatusReceived) {
+			return 0, 0, nil, errors.Join(transport.ErrPeerClosed, err)
+		}
 		return 0, 0, nil, err
 	}
 
@@ -69,29 +130,92 @@ func (c *Conn) NextReader() (message.MessageType, message.PacketType, io.ReadClo
 		}
 		pt, err = message.ParsePacketType(bs[0])
 		if err != nil {
-			c.errCh <- err
-			return 0, 0, nil, err
+			return 0, 0, nil, c.fail(err)
 		}
 	case message.MTBinary:
+		pt = message.PTMessage
+		// v3 binary frames start with the raw packet type
+		if c.proto == transport.Protocol3 {
+			bs := make([]byte, 1)
+			if _, err := r.Read(bs); err != nil {
+				return 0, 0, nil, err
+			}
+			pt, err = message.ParsePacketType(bs[0] + '0')
+			if err != nil {
+				return 0, 0, nil, c.fail(err)
+			}
+		}
+	}
+
+	return mt, pt, &reader{r: r}, nil
+}
+
+// fail reports err to ServeHTTP, which ends the session with it, and returns it.
+func (c *Conn) fail(err error) error {
+	select {
+	case c.errCh <- err:
+	case <-c.closeCh:
 	}
+	return err
+}
+
+type reader struct {
+	r io.Reader
+}
+
+func (r *reader) Read(bs []byte) (int, error) {
+	n, err := r.r.Read(bs)
+	if errors.Is(err, gorilla.ErrReadLimit) {
+		err = transport.ErrPayloadTooLarge
+	}
+	return n, err
+}
 
-	return mt, pt, r.(io.ReadCloser), nil
+func (r *reader) Close() error {
+	return nil
 }
 
 func (c *Conn) NextWriter(mt message.MessageType, pt message.PacketType) (io.WriteCloser, error) {
-	w, err := c.Conn.NextWriter(int(mt))
-	return &wrapper{
-		w:  w,
+	select {
+	case <-c.closeCh:
+		return nil, ErrClose
+	default:
+	}
+
+	w := &writer{
+		c:  c,
 		mt: mt,
-		pt: pt,
-	}, err
+	}
+	switch {
+	case mt == message.MTText:
+		w.buf.Write(pt.Bytes())
+	case c.proto == transport.Protocol3:
+		w.buf.WriteByte(byte(pt))
+	}
+	return w, nil
 }
 
+// Flush has nothing left to deliver, every frame is written when its writer is closed.
+func (c *Conn) Flush() transport.Delivery {
+	return transport.Delivered(nil)
+}
+
+// Close queues a close frame behind the pending frames, then closes the connection.
 func (c *Conn) Close(bool) error {
-	close(c.errCh)
+	err := ErrClose
+	c.closeOnce.Do(func() {
+		c.write(gorilla.CloseMessage, nil)
+		close(c.closeCh)
+		err = c.Conn.Close()
+	})
+	return err
+}
 
-	c.Conn.WriteMessage(gorilla.CloseMessage, nil)
-	return c.Conn.Close()
+// SetReadLimit makes gorilla answer oversized frames with a 1009 close frame.
+func (c *Conn) SetReadLimit(limit int64) {
+	if limit > 0 {
+		c.Conn.SetReadLimit(limit)
+	}
 }
 
 func (c *Conn) Name() string {
@@ -101,3 +225,6 @@ func (c *Conn) Name() string {
 func (c *Conn) Pause() {
 	log.Fatal("Websocket should never be paused")
 }
+
+func (c *Conn) Resume() {
+}
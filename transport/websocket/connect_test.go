@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/taogames/engine.igo/message"
+	"github.com/taogames/engine.igo/transport"
+)
+
+// dial accepts a v3 websocket conn and returns both of its ends.
+func dial(t *testing.T) (*Conn, *gorilla.Conn) {
+	t.Helper()
+	accepted := make(chan transport.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Default.Accept(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+		conn.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	c, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?EIO=3&transport=websocket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := (<-accepted).(*Conn)
+	t.Cleanup(func() {
+		c.Close()
+		conn.Close(true)
+	})
+	return conn, c
+}
+
+func TestV3BinaryFrame(t *testing.T) {
+	conn, c := dial(t)
+
+	c.WriteMessage(gorilla.BinaryMessage, []byte{4, 0xca, 0xfe})
+	mt, pt, rc, err := conn.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	if mt != message.MTBinary || pt != message.PTMessage || string(data) != "\xca\xfe" {
+		t.Errorf("got %v %v %x", mt, pt, data)
+	}
+}
+
+func TestV3BinaryFrameBadPacketType(t *testing.T) {
+	for _, b := range []byte{9, '4', 0xff} {
+		conn, c := dial(t)
+
+		c.WriteMessage(gorilla.BinaryMessage, []byte{b, 0xca, 0xfe})
+		if _, _, _, err := conn.NextReader(); !errors.Is(err, message.ErrInvalidPacket) {
+			t.Errorf("packet type %#x: NextReader = %v, want %v", b, err, message.ErrInvalidPacket)
+		}
+	}
+}
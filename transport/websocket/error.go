@@ -0,0 +1,6 @@
+package websocket
+
+import "errors"
+
+var ErrClose error = errors.New("Engine.IO websocket transport closed")
+var ErrCompressionLevel error = errors.New("Engine.IO websocket compression level out of range")
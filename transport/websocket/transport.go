@@ -1,36 +1,88 @@
 package websocket
 
 import (
+	"compress/flate"
 	"net/http"
+	"time"
 
 	gorilla "github.com/gorilla/websocket"
 	"github.com/taogames/engine.igo/transport"
 )
 
+const (
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultCompressionThreshold matches engine.io's perMessageDeflate threshold.
+	DefaultCompressionThreshold = 1024
+)
+
 type Transport struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	CheckOrigin     func(r *http.Request) bool
+
+	// HandshakeTimeout bounds the websocket handshake.
+	HandshakeTimeout time.Duration
+	// EnableCompression negotiates permessage-deflate with clients that offer it.
+	EnableCompression bool
+	// CompressionLevel is the flate level of compressed messages, from flate.HuffmanOnly to flate.BestCompression,
+	// gorilla's default if zero.
+	CompressionLevel int
+	// CompressionThreshold is the smallest message compressed, DefaultCompressionThreshold if zero.
+	CompressionThreshold int
+	// Subprotocols are the supported subprotocols, in order of preference.
+	Subprotocols []string
+
+	// WriteTimeout bounds every frame write, DefaultWriteTimeout if zero.
+	WriteTimeout time.Duration
 }
 
 var _ transport.Transport = (*Transport)(nil)
 
+// Default is shared by every server that is not given its own Transport.
 var Default = &Transport{}
 
 func (t *Transport) Name() string {
 	return "websocket"
 }
 
+// Validate checks t's settings once, rather than failing every connection after its handshake.
+func (t *Transport) Validate() error {
+	if t.CompressionLevel < flate.HuffmanOnly || t.CompressionLevel > flate.BestCompression {
+		return ErrCompressionLevel
+	}
+	return nil
+}
+
 func (t *Transport) Accept(w http.ResponseWriter, r *http.Request) (transport.Conn, error) {
 	upgrader := gorilla.Upgrader{
 		ReadBufferSize:  t.ReadBufferSize,
 		WriteBufferSize: t.WriteBufferSize,
 		CheckOrigin:     t.CheckOrigin,
+
+		HandshakeTimeout:  t.HandshakeTimeout,
+		EnableCompression: t.EnableCompression,
+		Subprotocols:      t.Subprotocols,
 	}
 	c, err := upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
 		return nil, err
 	}
 
-	return newConn(c), nil
+	if t.EnableCompression && t.CompressionLevel != 0 {
+		if err := c.SetCompressionLevel(t.CompressionLevel); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	writeTimeout := t.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	threshold := t.CompressionThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return newConn(c, transport.ProtocolOf(r), writeTimeout, threshold), nil
 }
@@ -0,0 +1,25 @@
+package websocket
+
+import (
+	"compress/flate"
+	"testing"
+)
+
+func TestValidateCompressionLevel(t *testing.T) {
+	for _, tt := range []struct {
+		level int
+		ok    bool
+	}{
+		{0, true},
+		{flate.HuffmanOnly, true},
+		{flate.BestSpeed, true},
+		{flate.BestCompression, true},
+		{flate.HuffmanOnly - 1, false},
+		{flate.BestCompression + 1, false},
+	} {
+		tr := &Transport{EnableCompression: true, CompressionLevel: tt.level}
+		if err := tr.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate with level %d = %v", tt.level, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package engineigo
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/taogames/engine.igo/message"
+	"go.uber.org/zap"
+)
+
+func newTestServer(t *testing.T, opts ...ServerOption) (*Server, *httptest.Server) {
+	t.Helper()
+	s := NewServer(append([]ServerOption{WithLogger(zap.NewNop().Sugar())}, opts...)...)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// handshake opens a polling session and returns it with its sid.
+func handshake(t *testing.T, s *Server, ts *httptest.Server) (*Session, string) {
+	t.Helper()
+	accepted := make(chan *Session, 1)
+	go func() { accepted <- <-s.Accept() }()
+
+	resp, err := http.Get(ts.URL + "/?EIO=4&transport=polling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var conf HandshakeConfig
+	if !strings.HasPrefix(string(body), "0") || json.Unmarshal(body[1:], &conf) != nil {
+		t.Fatalf("bad handshake response %q", body)
+	}
+	return <-accepted, conf.Sid
+}
+
+// poll sends a GET for sid and returns the response body.
+func poll(t *testing.T, ts *httptest.Server, sid string) string {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/?EIO=4&transport=polling&sid=" + sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: %d %q", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+// post sends payload for sid.
+func post(t *testing.T, ts *httptest.Server, sid, payload string) {
+	t.Helper()
+	resp, err := http.Post(ts.URL+"/?EIO=4&transport=polling&sid="+sid, "text/plain;charset=UTF-8", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST: %d %q", resp.StatusCode, body)
+	}
+}
+
+// dialUpgrade opens the websocket an upgrade of sid is probed on.
+func dialUpgrade(t *testing.T, ts *httptest.Server, sid string) *gorilla.Conn {
+	t.Helper()
+	c, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?EIO=4&transport=websocket&sid="+sid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// sendProbe sends the client's probe on c and checks the server's answer.
+func sendProbe(t *testing.T, c *gorilla.Conn) {
+	t.Helper()
+	if err := c.WriteMessage(gorilla.TextMessage, []byte("2probe")); err != nil {
+		t.Fatal(err)
+	}
+	if _, probe, err := c.ReadMessage(); err != nil || string(probe) != "3probe" {
+		t.Fatalf("probe: %q %v", probe, err)
+	}
+}
+
+func TestUpgradeKeepsReadingPolling(t *testing.T) {
+	s, ts := newTestServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	c, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?EIO=4&transport=websocket&sid="+sid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(gorilla.TextMessage, []byte("2probe")); err != nil {
+		t.Fatal(err)
+	}
+	if _, probe, err := c.ReadMessage(); err != nil || string(probe) != "3probe" {
+		t.Fatalf("probe: %q %v", probe, err)
+	}
+	// the old conn is paused once 3probe is sent
+	time.Sleep(50 * time.Millisecond)
+
+	// a POST already in flight when the client sees 3probe
+	resp, err := http.Post(ts.URL+"/?EIO=4&transport=polling&sid="+sid, "text/plain;charset=UTF-8", strings.NewReader("4hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST during upgrade: %d %q", resp.StatusCode, body)
+	}
+
+	if err := c.WriteMessage(gorilla.TextMessage, []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := sess.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("ReadMessage: %q %v", data, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sess.Transport() != "websocket" {
+		if time.Now().After(deadline) {
+			t.Fatal("session not upgraded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reason := sess.CloseReason(); reason != "" {
+		t.Fatalf("session closed: %s %v", reason, sess.CloseError())
+	}
+
+	if err := c.WriteMessage(gorilla.TextMessage, []byte("4after")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := sess.ReadMessage(); err != nil || string(data) != "after" {
+		t.Fatalf("ReadMessage after upgrade: %q %v", data, err)
+	}
+}
+
+// newUpgradeFailServer returns a server timing out upgrades quickly, and the errors its upgrades fail with.
+func newUpgradeFailServer(t *testing.T) (*Server, *httptest.Server, chan error) {
+	failed := make(chan error, 1)
+	s, ts := newTestServer(t,
+		WithUpgradeTimeout(100*time.Millisecond),
+		WithOnUpgradeFailed(func(_ *Session, err error) { failed <- err }),
+	)
+	return s, ts, failed
+}
+
+// assertPolling checks that sess is still open on polling and carries traffic both ways.
+func assertPolling(t *testing.T, ts *httptest.Server, sess *Session, sid string) {
+	t.Helper()
+	if transport := sess.Transport(); transport != "polling" {
+		t.Fatalf("Transport = %s, want polling", transport)
+	}
+	if reason := sess.CloseReason(); reason != "" {
+		t.Fatalf("session closed: %s %v", reason, sess.CloseError())
+	}
+
+	sess.WriteMessage(&message.Message{Type: message.MTText, Data: []byte("down")})
+	if body := poll(t, ts, sid); body != "4down" {
+		t.Errorf("GET = %q, want %q", body, "4down")
+	}
+	post(t, ts, sid, "4up")
+	if _, data, err := sess.ReadMessage(); err != nil || string(data) != "up" {
+		t.Errorf("ReadMessage = %q %v", data, err)
+	}
+}
+
+func TestUpgradeProbeTimeout(t *testing.T) {
+	s, ts, failed := newUpgradeFailServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	// the client never probes
+	dialUpgrade(t, ts, sid)
+	if err := <-failed; !errors.Is(err, ErrUpgradeTimeout) {
+		t.Fatalf("upgrade failed with %v, want %v", err, ErrUpgradeTimeout)
+	}
+	assertPolling(t, ts, sess, sid)
+}
+
+func TestUpgradeMissingUpgradePacket(t *testing.T) {
+	s, ts, failed := newUpgradeFailServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	// the old conn is paused once the probe is answered, then the client never sends 5
+	sendProbe(t, dialUpgrade(t, ts, sid))
+	if err := <-failed; !errors.Is(err, ErrUpgradeTimeout) {
+		t.Fatalf("upgrade failed with %v, want %v", err, ErrUpgradeTimeout)
+	}
+	assertPolling(t, ts, sess, sid)
+}
+
+func TestUpgradeRetryAfterRollback(t *testing.T) {
+	s, ts, failed := newUpgradeFailServer(t)
+	sess, sid := handshake(t, s, ts)
+
+	sendProbe(t, dialUpgrade(t, ts, sid))
+	// queued while the old conn is paused, sent once it resumes
+	sess.WriteMessage(&message.Message{Type: message.MTText, Data: []byte("paused")})
+	if err := <-failed; !errors.Is(err, ErrUpgradeTimeout) {
+		t.Fatalf("upgrade failed with %v, want %v", err, ErrUpgradeTimeout)
+	}
+	if body := poll(t, ts, sid); body != "4paused" {
+		t.Fatalf("GET after rollback = %q, want %q", body, "4paused")
+	}
+	assertPolling(t, ts, sess, sid)
+
+	c := dialUpgrade(t, ts, sid)
+	sendProbe(t, c)
+	if err := c.WriteMessage(gorilla.TextMessage, []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	sess.WriteMessage(&message.Message{Type: message.MTText, Data: []byte("upgraded")})
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "4upgraded" {
+		t.Fatalf("websocket read %q %v", data, err)
+	}
+	if transport := sess.Transport(); transport != "websocket" {
+		t.Errorf("Transport = %s, want websocket", transport)
+	}
+	select {
+	case err := <-failed:
+		t.Errorf("retried upgrade failed: %v", err)
+	default:
+	}
+}
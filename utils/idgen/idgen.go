@@ -1,6 +1,9 @@
 package idgen
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"strconv"
 
 	"github.com/google/uuid"
@@ -11,24 +14,55 @@ type Generator interface {
 	NextID() (string, error)
 }
 
-var Default Generator = &sfWrapper{
-	Sonyflake: sonyflake.NewSonyflake(sonyflake.Settings{}),
-}
+// Default generates unguessable ids, since knowing a sid is enough to post into its session.
+var Default Generator = &Random{}
 
-type sfWrapper struct {
-	*sonyflake.Sonyflake
+// DefaultRandomSize is the number of random bytes in a Random id, 128 bits.
+const DefaultRandomSize = 16
+
+// Random generates base64url ids from Size bytes of crypto/rand.
+type Random struct {
+	Size int
 }
 
-func (g *sfWrapper) NextID() (string, error) {
-	id, err := g.Sonyflake.NextID()
+func (g *Random) NextID() (string, error) {
+	size := g.Size
+	if size <= 0 {
+		size = DefaultRandomSize
+	}
 
-	return strconv.FormatUint(id, 10), err
+	bs := make([]byte, size)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
 }
 
-type uuidWrapper struct {
+// UUID generates random (version 4) UUIDs.
+type UUID struct {
 }
 
-func (g *uuidWrapper) NextID() (string, error) {
+func (g *UUID) NextID() (string, error) {
 	u, err := uuid.NewRandom()
 	return u.String(), err
 }
+
+// NewSonyflake returns a generator of time-ordered ids.
+// They are guessable from one another, so only use it when sids are otherwise protected.
+func NewSonyflake(st sonyflake.Settings) (Generator, error) {
+	sf := sonyflake.NewSonyflake(st)
+	if sf == nil {
+		return nil, errors.New("sonyflake: invalid settings")
+	}
+	return &sfWrapper{Sonyflake: sf}, nil
+}
+
+type sfWrapper struct {
+	*sonyflake.Sonyflake
+}
+
+func (g *sfWrapper) NextID() (string, error) {
+	id, err := g.Sonyflake.NextID()
+
+	return strconv.FormatUint(id, 10), err
+}